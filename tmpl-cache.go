@@ -0,0 +1,112 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// DefaultPartialCacheSize is used when Config.PartialCacheSize isn't set
+const DefaultPartialCacheSize = 1024
+
+// outputCache keeps rendered output along with the entries of the templates
+// that produced it. Output is only returned while all of them are still in
+// the store: reloading a template, or a base it is built on, replaces its
+// entry and so invalidates everything rendered with it
+type outputCache struct {
+	sync.Mutex
+	lru     *simplelru.LRU // key: cache key; value: *cachedOutput
+	size    int64
+	maxSize int64
+	ttl     time.Duration
+}
+
+type cachedOutput struct {
+	out     []byte
+	deps    map[string]*tmplEntry
+	expires time.Time
+}
+
+// newOutputCache makes a cache of up to count outputs and maxSize bytes,
+// 0 meaning no byte limit. Outputs expire after ttl, or never if it is 0
+func newOutputCache(count int, maxSize int64, ttl time.Duration) *outputCache {
+	c := &outputCache{maxSize: maxSize, ttl: ttl}
+	lru, err := simplelru.NewLRU(count, func(key, value interface{}) {
+		c.size -= int64(len(value.(*cachedOutput).out))
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.lru = lru
+	return c
+}
+
+// get returns the output cached under key if it is still valid in snap
+func (c *outputCache) get(key string, snap *storeSnapshot) ([]byte, map[string]*tmplEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	co := v.(*cachedOutput)
+	if c.ttl > 0 && time.Now().After(co.expires) {
+		c.lru.Remove(key)
+		return nil, nil, false
+	}
+	for name, e := range co.deps {
+		if cur, ok := snap.get(name); !ok || cur != e {
+			c.lru.Remove(key)
+			return nil, nil, false
+		}
+	}
+	return co.out, co.deps, true
+}
+
+// put caches out under key. Output larger than the whole cache isn't kept
+func (c *outputCache) put(key string, out []byte, deps map[string]*tmplEntry) {
+	size := int64(len(out))
+	if c.maxSize > 0 && size > c.maxSize {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.lru.Remove(key)
+	co := &cachedOutput{out: out, deps: deps}
+	if c.ttl > 0 {
+		co.expires = time.Now().Add(c.ttl)
+	}
+	c.size += size
+	c.lru.Add(key, co)
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.lru.RemoveOldest()
+	}
+}
+
+// cacheKey joins the parts of a cache key
+func cacheKey(tenant, name string, variants []interface{}) string {
+	key := tenant + "\x00" + name
+	for _, v := range variants {
+		key += "\x00" + fmt.Sprint(v)
+	}
+	return key
+}
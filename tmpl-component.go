@@ -0,0 +1,284 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"fmt"
+	"html/template"
+	"sync/atomic"
+	"text/template/parse"
+
+	helpers "github.com/bryanjeal/go-helpers"
+)
+
+// componentSeq numbers the templates made of component bodies
+var componentSeq uint64
+
+// A component is a partial called with a body. The body, and any slots in it,
+// are rendered where the partial calls "slot":
+//
+//	{{ with component "card" "title" .Title }}
+//		<p>{{ .Summary }}</p>
+//		{{ with slot "footer" }}<a href="{{ .URL }}">More</a>{{ end }}
+//	{{ end }}
+//
+// and partials/_card.html:
+//
+//	<div class="card"><h2>{{ .title }}</h2>{{ slot }}<footer>{{ slot "footer" }}</footer></div>
+//
+// The body and the slots are executed as part of the caller's template, with
+// dot and $ as they are at the component block. They are escaped in their own
+// HTML context and can't use the caller's other variables. Slots are the
+// "with slot" blocks at the top level of the body. "hasSlot" reports if a slot
+// was given.
+//
+// rewriteComponents runs when a template is parsed. It replaces each component
+// block with
+//
+//	{{ component "card" (slots "$component1" . $) "title" .Title }}
+//
+// and adds the body, without its slots, to the set as "$component1" and each
+// slot as "$component1.footer". Slot templates are executed with the caller's
+// $ as their data and their content is wrapped in
+//
+//	{{ range slotDot }}...{{ end }}
+//
+// to set dot, even if it is empty
+func rewriteComponents(set *template.Template) error {
+	for _, st := range set.Templates() {
+		if st.Tree == nil {
+			continue
+		}
+		err := rewriteComponentsIn(set, st.Tree.Root)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rewriteComponentsIn(set *template.Template, root parse.Node) error {
+	var err error
+	walkNodes(root, func(n parse.Node) {
+		list, ok := n.(*parse.ListNode)
+		if !ok || err != nil {
+			return
+		}
+		for i, c := range list.Nodes {
+			w, ok := c.(*parse.WithNode)
+			if !ok || !isComponentBlock(w) {
+				continue
+			}
+			var a *parse.ActionNode
+			a, err = addComponentBody(set, w)
+			if err != nil {
+				return
+			}
+			list.Nodes[i] = a
+		}
+	})
+	return err
+}
+
+// isComponentBlock reports if w is {{ with component "name" ... }} without
+// an else branch
+func isComponentBlock(w *parse.WithNode) bool {
+	if w.ElseList != nil || len(w.Pipe.Decl) > 0 || len(w.Pipe.Cmds) != 1 {
+		return false
+	}
+	_, ok := constCallName(w.Pipe.Cmds[0], "component")
+	return ok
+}
+
+// addComponentBody adds the body and slots of the component block w to set
+// and returns the action that calls the component with them
+func addComponentBody(set *template.Template, w *parse.WithNode) (*parse.ActionNode, error) {
+	prefix := fmt.Sprintf("$component%d", atomic.AddUint64(&componentSeq, 1))
+
+	body := &parse.ListNode{NodeType: parse.NodeList, Pos: w.List.Pos}
+	for _, c := range w.List.Nodes {
+		sw, ok := c.(*parse.WithNode)
+		if !ok || sw.ElseList != nil || len(sw.Pipe.Decl) > 0 || len(sw.Pipe.Cmds) != 1 {
+			body.Nodes = append(body.Nodes, c)
+			continue
+		}
+		slot, ok := constCallName(sw.Pipe.Cmds[0], "slot")
+		if !ok {
+			body.Nodes = append(body.Nodes, c)
+			continue
+		}
+		err := addSlot(set, prefix+"."+slot, sw.List)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := addSlot(set, prefix, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// component "name" (slots "prefix" . $) args...
+	cmd := w.Pipe.Cmds[0]
+	slots := &parse.PipeNode{
+		NodeType: parse.NodePipe,
+		Pos:      cmd.Pos,
+		Line:     w.Line,
+		Cmds: []*parse.CommandNode{{
+			NodeType: parse.NodeCommand,
+			Pos:      cmd.Pos,
+			Args: []parse.Node{
+				parse.NewIdentifier("slots").SetPos(cmd.Pos),
+				&parse.StringNode{NodeType: parse.NodeString, Pos: cmd.Pos, Quoted: fmt.Sprintf("%q", prefix), Text: prefix},
+				&parse.DotNode{NodeType: parse.NodeDot, Pos: cmd.Pos},
+				&parse.VariableNode{NodeType: parse.NodeVariable, Pos: cmd.Pos, Ident: []string{"$"}},
+			},
+		}},
+	}
+	args := append([]parse.Node{cmd.Args[0], cmd.Args[1], slots}, cmd.Args[2:]...)
+	return &parse.ActionNode{
+		NodeType: parse.NodeAction,
+		Pos:      w.Pos,
+		Line:     w.Line,
+		Pipe: &parse.PipeNode{
+			NodeType: parse.NodePipe,
+			Pos:      w.Pipe.Pos,
+			Line:     w.Line,
+			Cmds: []*parse.CommandNode{{
+				NodeType: parse.NodeCommand,
+				Pos:      cmd.Pos,
+				Args:     args,
+			}},
+		},
+	}, nil
+}
+
+// addSlot adds the content of a slot to set as the template "name"
+func addSlot(set *template.Template, name string, list *parse.ListNode) error {
+	if v, ok := outerVariable(list); ok {
+		return fmt.Errorf("template: %s: component bodies can't use the caller's variable %s", set.Name(), v)
+	}
+	err := rewriteComponentsIn(set, list)
+	if err != nil {
+		return err
+	}
+	// {{ range slotDot }}list{{ end }}
+	dot := &parse.RangeNode{BranchNode: parse.BranchNode{
+		NodeType: parse.NodeRange,
+		Pos:      list.Pos,
+		Pipe: &parse.PipeNode{
+			NodeType: parse.NodePipe,
+			Pos:      list.Pos,
+			Cmds: []*parse.CommandNode{{
+				NodeType: parse.NodeCommand,
+				Pos:      list.Pos,
+				Args:     []parse.Node{parse.NewIdentifier("slotDot").SetPos(list.Pos)},
+			}},
+		},
+		List: list,
+	}}
+	root := &parse.ListNode{NodeType: parse.NodeList, Pos: list.Pos, Nodes: []parse.Node{dot}}
+	_, err = set.AddParseTree(name, &parse.Tree{Name: name, ParseName: set.Name(), Root: root})
+	return err
+}
+
+// outerVariable returns a variable that is used in list but not declared in
+// it, other than $
+func outerVariable(list *parse.ListNode) (string, bool) {
+	declared := map[string]bool{"$": true}
+	var used []string
+	walkNodes(list, func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.PipeNode:
+			for _, v := range n.Decl {
+				declared[v.Ident[0]] = true
+			}
+		case *parse.VariableNode:
+			used = append(used, n.Ident[0])
+		}
+	})
+	for _, v := range used {
+		if !declared[v] {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// slotSet is the body and slots a component block passes to its partial.
+// They are executed by the caller's renderer at the caller's depth of calls,
+// with ctx and root, the caller's dot and $
+type slotSet struct {
+	rd     *renderer
+	prefix string
+	ctx    interface{}
+	root   interface{}
+	depth  int
+}
+
+// component executes a partial as part of render r, with the slots of a
+// component block if it was called by one
+func (t *TplSys) component(r *render, name string, args ...interface{}) (template.HTML, error) {
+	var slots *slotSet
+	if len(args) > 0 {
+		if s, ok := args[0].(*slotSet); ok {
+			slots, args = s, args[1:]
+		}
+	}
+	return t.renderPartial(r, name, slots, args)
+}
+
+// slotTemplate returns the template of the slot "name" of the innermost
+// component, or of its body if name is empty
+func (r *render) slotTemplate(name string) (*slotSet, *template.Template) {
+	if len(r.calls) == 0 {
+		return nil, nil
+	}
+	s := r.calls[len(r.calls)-1].slots
+	if s == nil {
+		return nil, nil
+	}
+	if name != "" {
+		name = "." + name
+	}
+	return s, s.rd.tmpl.Lookup(s.prefix + name)
+}
+
+// slot renders the slot "name" of the innermost component, or its body
+// without a name. A slot that wasn't given renders nothing
+func (t *TplSys) slot(r *render, names ...string) (template.HTML, error) {
+	var name string
+	if len(names) > 0 {
+		name = names[0]
+	}
+	s, tmpl := r.slotTemplate(name)
+	if tmpl == nil {
+		return template.HTML(""), nil
+	}
+
+	// the content is the caller's, render it from where the caller was
+	calls := r.calls
+	r.calls = calls[:s.depth:s.depth]
+	defer func() { r.calls = calls }()
+
+	b := helpers.BufferPool.Get()
+	defer helpers.BufferPool.Put(b)
+	// slotDot is read as soon as the template starts
+	r.slotDot = s.ctx
+	err := tmpl.Execute(b, s.root)
+	if err != nil {
+		return template.HTML(""), err
+	}
+	return template.HTML(b.String()), nil
+}
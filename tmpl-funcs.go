@@ -32,6 +32,7 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"path"
 	"reflect"
 	"regexp"
 	"sort"
@@ -1779,42 +1780,238 @@ func htmlUnescape(in interface{}) (string, error) {
 }
 
 // Partial is the handler for "partial" template function (FuncMap)
-// It will add the template to the store if needed and execute it
+// It will add the template to the store if needed and execute it.
+// The partial is called with the only context passed, or with a map of named
+// arguments:
+//
+//	{{ partial "card" "title" .Title "url" .URL }}
+//
+// The context passed to ExecuteTemplate is available to partials as "root"
+// Partial can't return an error, so with Config.StrictPartials set a failed
+// partial is logged and rendered as nothing
 func (t *TplSys) Partial(name string, ctxs ...interface{}) template.HTML {
-	// trim "path" from partial template name
-	name = strings.TrimPrefix(name, t.BaseDir()+"partials/")
-	name = strings.TrimPrefix(name, "/")
-	name = strings.TrimPrefix(name, "partials/")
+	h, err := t.partial(t.newRender("", nil), name, ctxs...)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return h
+}
 
-	// context to pass along to template renderer
-	var ctx interface{}
+// PartialValue is the handler for "partialValue" template function (FuncMap)
+// It executes a partial like Partial but returns the value the partial passed
+// to "return" instead of its output, so a partial can compute data for its
+// caller:
+//
+//	{{ $total := partialValue "sum" "items" .Items }}
+func (t *TplSys) PartialValue(name string, ctxs ...interface{}) (interface{}, error) {
+	return t.partialValue(t.newRender("", nil), name, ctxs...)
+}
 
-	// if no context is provided the pass nil
-	// otherwise only use the first one
-	if len(ctxs) == 0 {
-		ctx = nil
-	} else {
-		ctx = ctxs[0]
+// partial executes a partial as part of render r. Unless
+// Config.StrictPartials is set its errors are logged and the placeholder is
+// rendered instead. ErrPartialDepth always aborts the render
+func (t *TplSys) partial(r *render, name string, ctxs ...interface{}) (template.HTML, error) {
+	return t.renderPartial(r, name, nil, ctxs)
+}
+
+// renderPartial executes a partial as part of render r, see partial. slots
+// are passed by component blocks
+func (t *TplSys) renderPartial(r *render, name string, slots *slotSet, ctxs []interface{}) (template.HTML, error) {
+	b, _, err := t.callPartial(r, name, slots, ctxs)
+	return t.partialOutput(r, b, err)
+}
+
+// partialOutput returns the output of a partial call, or the placeholder if
+// it failed and the render can go on
+func (t *TplSys) partialOutput(r *render, b []byte, err error) (template.HTML, error) {
+	if err != nil {
+		// runaway recursion must not carry on, whatever the mode
+		if t.config.StrictPartials || err.(*PartialError).Err == ErrPartialDepth {
+			return template.HTML(""), err
+		}
+		// the render goes on
+		r.failed = nil
+		r.degraded = true
+		log.Println(err.Error())
+		return t.config.PartialPlaceholder, nil
+	}
+	return template.HTML(string(b)), nil
+}
+
+// PartialCached is the handler for "partialCached" template function (FuncMap)
+// It executes a partial like Partial and keeps the output, so later calls
+// with the same variants return it without executing the partial again:
+//
+//	{{ partialCached "header" . .Lang }}
+//
+// The context isn't part of the key, calls that render differently must pass
+// different variants. An output is dropped when the partial, or any template
+// it was rendered with, changes. Output with a failed partial isn't kept
+func (t *TplSys) PartialCached(name string, ctx interface{}, variants ...interface{}) template.HTML {
+	h, err := t.partialCached(t.newRender("", nil), name, ctx, variants...)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return h
+}
+
+// partialCached executes a partial as part of render r, or returns its output
+// from the cache
+func (t *TplSys) partialCached(r *render, name string, ctx interface{}, variants ...interface{}) (template.HTML, error) {
+	key := cacheKey(r.tenant, t.resolvePartial(r.snap, r.tenant, name), variants)
+	if out, deps, ok := t.partialOutputs.get(key, r.snap); ok {
+		r.addDeps(deps)
+		return template.HTML(string(out)), nil
+	}
+
+	// collect what the partial executes, separately from an outer
+	// partialCached call
+	outerDeps, outerDegraded := r.deps, r.degraded
+	r.deps, r.degraded = make(map[string]*tmplEntry), false
+	h, err := t.partial(r, name, ctx)
+	deps, degraded := r.deps, r.degraded
+	r.deps, r.degraded = outerDeps, outerDegraded || degraded
+	r.addDeps(deps)
+
+	if err == nil && !degraded {
+		t.partialOutputs.put(key, []byte(h), deps)
+	}
+	return h, err
+}
+
+// partialValue executes a partial as part of render r for its return value
+func (t *TplSys) partialValue(r *render, name string, ctxs ...interface{}) (interface{}, error) {
+	_, v, err := t.callPartial(r, name, nil, ctxs)
+	return v, err
+}
+
+// callPartial executes a partial and returns its output and the value it
+// returned, if any. Errors are returned as a *PartialError
+func (t *TplSys) callPartial(r *render, name string, slots *slotSet, ctxs []interface{}) (b []byte, v interface{}, err error) {
+	name = t.resolvePartial(r.snap, r.tenant, name)
+	defer func() {
+		if err != nil {
+			err = t.partialFailed(r, name, err)
+		}
+	}()
+
+	// context to pass along to template renderer
+	ctx, err := partialContext(ctxs)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// make sure partial template is in the store
 	// if it isn't then add it
-	_, err := t.getTemplate(name)
-	if err == ErrTmplNotFound {
-		_, err := t.AddTemplate(name, "", "", t.BaseDir()+"partials/"+name)
-		if err != nil {
-			log.Println(err.Error())
-			return template.HTML("")
+	e, snap, err := t.loadPartial(r.snap, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(e.layer.params) > 0 {
+		args, perr := bindParams(e.layer.params, ctx)
+		if perr != nil {
+			perr.Partial = name
+			perr.Caller = r.caller()
+			return nil, nil, perr
 		}
+		ctx = args
+	}
+	if snap != r.snap {
+		// it only exists in the snapshot that was just published
+		defer r.useSnap(snap)()
+	}
+
+	// the error shows the chain of calls that got this deep
+	if len(r.calls) >= t.maxPartialDepth() {
+		return nil, nil, ErrPartialDepth
 	}
 
 	// execute template
-	b, err := t.ExecuteTemplate(name, ctx)
+	f := r.pushCall(name, slots)
+	defer r.popCall()
+	b, err = t.execute(r, name, ctx)
 	if err != nil {
-		log.Println(err.Error())
-		return template.HTML("")
+		return nil, nil, err
+	}
+	return b, f.value, nil
+}
+
+// partialFailed returns the *PartialError for the failed partial call "name"
+// and counts the failure where it happened
+func (t *TplSys) partialFailed(r *render, name string, err error) *PartialError {
+	perr, first := r.partialError(name, err)
+	if first {
+		t.failures.add(name)
+	}
+	return perr
+}
+
+func (t *TplSys) maxPartialDepth() int {
+	if t.config.MaxPartialDepth > 0 {
+		return t.config.MaxPartialDepth
+	}
+	return DefaultMaxPartialDepth
+}
+
+// partialContext returns the context a partial is called with: nil, the only
+// argument or a map of the named arguments
+func partialContext(ctxs []interface{}) (interface{}, error) {
+	switch len(ctxs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ctxs[0], nil
 	}
-	return template.HTML(string(b))
+
+	if len(ctxs)%2 != 0 {
+		return nil, ErrPartialArgs
+	}
+	args := make(map[string]interface{}, len(ctxs)/2)
+	for i := 0; i < len(ctxs); i += 2 {
+		k, ok := ctxs[i].(string)
+		if !ok {
+			return nil, ErrPartialArgs
+		}
+		args[k] = ctxs[i+1]
+	}
+	return args, nil
+}
+
+// loadPartial returns the partial with "name" from snap. If it isn't in the
+// store it is added, and returned with the snapshot that has it
+func (t *TplSys) loadPartial(snap *storeSnapshot, name string) (*tmplEntry, *storeSnapshot, error) {
+	if e, ok := snap.get(name); ok {
+		return e, snap, nil
+	}
+
+	// in lazy mode the partial may only need to be loaded
+	e, snap, err := t.loadTemplate(name)
+	if err != ErrTmplNotFound {
+		return e, snap, err
+	}
+
+	// a computed name like "../../etc/passwd" must not leave the partials
+	if !strings.HasPrefix(name, NamespacePartial) {
+		return nil, nil, ErrPathEscapes
+	}
+
+	err = t.hasTemplate(name)
+	if err == ErrTmplNotFound {
+		_, err = t.saveTemplate(name, "", true, true, "", name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.loadTemplate(name)
+}
+
+// partialName returns the key of a partial template. Partials are keyed by
+// their path relative to BaseDir, which is always in NamespacePartial
+func (t *TplSys) partialName(name string) string {
+	name = strings.TrimPrefix(name, t.BaseDir())
+	name = strings.TrimPrefix(name, "/")
+	name = strings.TrimPrefix(name, NamespacePartial)
+	return path.Clean(NamespacePartial + name)
 }
 
 func (t *TplSys) genFuncMap() template.FuncMap {
@@ -1825,6 +2022,9 @@ func (t *TplSys) genFuncMap() template.FuncMap {
 		"base64Decode": base64Decode,
 		"base64Encode": base64Encode,
 		"chomp":        chomp,
+		"component": func(name string, args ...interface{}) (template.HTML, error) {
+			return t.component(t.newRender("", nil), name, args...)
+		},
 		"countrunes":   countRunes,
 		"countwords":   countWords,
 		"default":      dfault,
@@ -1841,6 +2041,7 @@ func (t *TplSys) genFuncMap() template.FuncMap {
 		"getenv":       func(varName string) string { return os.Getenv(varName) },
 		"gt":           gt,
 		"hasPrefix":    func(a, b string) bool { return strings.HasPrefix(a, b) },
+		"hasSlot":      func(name string) bool { return false },
 		"highlight":    highlight,
 		"htmlEscape":   htmlEscape,
 		"htmlUnescape": htmlUnescape,
@@ -1861,12 +2062,20 @@ func (t *TplSys) genFuncMap() template.FuncMap {
 		"modBool":      modBool,
 		"mul":          func(a, b interface{}) (interface{}, error) { return hugoHelpers.DoArithmetic(a, b, '*') },
 		"ne":           ne,
-		"partial":      t.Partial,
+		"partial": func(name string, ctxs ...interface{}) (template.HTML, error) {
+			return t.partial(t.newRender("", nil), name, ctxs...)
+		},
+		"partialCached": func(name string, ctx interface{}, variants ...interface{}) (template.HTML, error) {
+			return t.partialCached(t.newRender("", nil), name, ctx, variants...)
+		},
+		"partialValue": t.PartialValue,
 		"plainify":     plainify,
 		"pluralize":    pluralize,
 		"querify":      querify,
 		"replace":      replace,
 		"replaceRE":    replaceRE,
+		"return":       func(v interface{}) string { return "" },
+		"root":         func() interface{} { return nil },
 		"safeCSS":      safeCSS,
 		"safeHTML":     safeHTML,
 		"safeHTMLAttr": safeHTMLAttr,
@@ -1880,6 +2089,9 @@ func (t *TplSys) genFuncMap() template.FuncMap {
 		"singularize":  singularize,
 		"slice":        slice,
 		"slicestr":     slicestr,
+		"slot":         func(names ...string) template.HTML { return "" },
+		"slotDot":      func() []interface{} { return nil },
+		"slots":        func(prefix string, ctx, root interface{}) interface{} { return nil },
 		"sort":         sortSeq,
 		"split":        split,
 		"string":       func(v interface{}) (string, error) { return cast.ToStringE(v) },
@@ -0,0 +1,285 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"text/template/parse"
+)
+
+// Graph edge kinds
+const (
+	// EdgeBase points from a template to the template it is based on
+	EdgeBase = "base"
+	// EdgePartial points from a template to a partial it calls
+	EdgePartial = "partial"
+)
+
+// Graph is the template inheritance and partial dependency graph
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a template in the Graph. Partials that are called but not
+// loaded yet are included with Loaded set to false
+type GraphNode struct {
+	Name   string `json:"name"`
+	Loaded bool   `json:"loaded"`
+}
+
+// GraphEdge is a dependency of one template on another
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// JSON returns the graph encoded as JSON
+func (g Graph) JSON() ([]byte, error) {
+	return json.Marshal(g)
+}
+
+// DOT returns the graph in the Graphviz DOT language
+func (g Graph) DOT() string {
+	var b bytes.Buffer
+	b.WriteString("digraph templates {\n")
+	for _, n := range g.Nodes {
+		if n.Loaded {
+			fmt.Fprintf(&b, "\t%q;\n", n.Name)
+		} else {
+			fmt.Fprintf(&b, "\t%q [style=dashed];\n", n.Name)
+		}
+	}
+	for _, e := range g.Edges {
+		if e.Kind == EdgePartial {
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q, style=dashed];\n", e.From, e.To, e.Kind)
+		} else {
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q];\n", e.From, e.To, e.Kind)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Graph returns the dependency graph of all templates in the store
+func (t *TplSys) Graph() Graph {
+	t.store.RLock()
+	defer t.store.RUnlock()
+
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	var g Graph
+	snap := t.store.load()
+	loaded := make(map[string]bool)
+	called := make(map[string]bool)
+
+	result, err := tx.Get("tmplData", "id")
+	if err != nil {
+		return g
+	}
+	for r := result.Next(); r != nil; r = result.Next() {
+		td := r.(*tmplData)
+		loaded[td.Name] = true
+		g.Nodes = append(g.Nodes, GraphNode{Name: td.Name, Loaded: true})
+
+		if td.HasBaseTmpl {
+			g.Edges = append(g.Edges, GraphEdge{From: td.Name, To: td.BaseTmplID, Kind: EdgeBase})
+		}
+		// a template's own source only, the calls of its base are the base's
+		// edges. Lazily loaded templates that aren't loaded are parsed
+		var tmpl *template.Template
+		if e, ok := snap.get(td.Name); ok {
+			tmpl = e.layer.tmpl
+		} else if layer, err := t.parseLayer(td.Name, td.Name, td.Src, td.Filenames); err == nil {
+			tmpl = layer.tmpl
+		}
+		for _, p := range t.partialCalls(tmpl) {
+			called[p] = true
+			g.Edges = append(g.Edges, GraphEdge{From: td.Name, To: p, Kind: EdgePartial})
+		}
+	}
+
+	var missing []string
+	for p := range called {
+		if !loaded[p] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+	for _, p := range missing {
+		g.Nodes = append(g.Nodes, GraphNode{Name: p})
+	}
+	return g
+}
+
+// Ancestors returns the chain of base templates of "name", nearest first
+func (t *TplSys) Ancestors(name string) ([]string, error) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	t.store.RLock()
+	defer t.store.RUnlock()
+
+	return t.ancestorTemplates(name), nil
+}
+
+// ancestorTemplates must be called with the store (read) locked
+func (t *TplSys) ancestorTemplates(name string) []string {
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	var names []string
+	seen := map[string]bool{name: true}
+	for {
+		r, err := tx.First("tmplData", "id", name)
+		if err != nil || r == nil {
+			return names
+		}
+		td := r.(*tmplData)
+		if !td.HasBaseTmpl || seen[td.BaseTmplID] {
+			return names
+		}
+		name = td.BaseTmplID
+		seen[name] = true
+		names = append(names, name)
+	}
+}
+
+// Descendants returns the names of all templates based on "name", directly
+// or indirectly. These are the templates rebuilt when "name" changes
+func (t *TplSys) Descendants(name string) ([]string, error) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	t.store.RLock()
+	defer t.store.RUnlock()
+
+	return t.descendantTemplates(name), nil
+}
+
+// partialCalls returns the sorted keys of the partials called with a
+// constant name anywhere in tmpl's template set, which should be a layer so
+// the calls of its base aren't included
+func (t *TplSys) partialCalls(tmpl *template.Template) []string {
+	if tmpl == nil {
+		return nil
+	}
+
+	snap := t.store.load()
+	seen := make(map[string]bool)
+	for _, st := range tmpl.Templates() {
+		if st.Tree == nil {
+			continue
+		}
+		walkNodes(st.Tree.Root, func(n parse.Node) {
+			if name, ok := partialCallName(n); ok {
+				seen[t.resolvePartial(snap, "", name)] = true
+			}
+			if name, ok := constCallName(n, "component"); ok {
+				seen[t.resolvePartial(snap, "", name)] = true
+			}
+		})
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// partialCallName returns the partial name if n is a call of the "partial"
+// function with a string constant as its name
+func partialCallName(n parse.Node) (string, bool) {
+	return constCallName(n, "partial")
+}
+
+// constCallName returns the first argument of n if it is a call of the
+// function fn with a string constant as its first argument
+func constCallName(n parse.Node, fn string) (string, bool) {
+	cmd, ok := n.(*parse.CommandNode)
+	if !ok || len(cmd.Args) < 2 {
+		return "", false
+	}
+	id, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok || id.Ident != fn {
+		return "", false
+	}
+	s, ok := cmd.Args[1].(*parse.StringNode)
+	if !ok {
+		return "", false
+	}
+	return s.Text, true
+}
+
+// walkNodes calls fn for n and every node below it
+func walkNodes(n parse.Node, fn func(parse.Node)) {
+	// optional lists and pipelines are typed nils
+	switch n := n.(type) {
+	case nil:
+		return
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+	}
+	fn(n)
+
+	switch n := n.(type) {
+	case *parse.ListNode:
+		for _, c := range n.Nodes {
+			walkNodes(c, fn)
+		}
+	case *parse.ActionNode:
+		walkNodes(n.Pipe, fn)
+	case *parse.PipeNode:
+		for _, c := range n.Cmds {
+			walkNodes(c, fn)
+		}
+	case *parse.CommandNode:
+		for _, c := range n.Args {
+			walkNodes(c, fn)
+		}
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		walkNodes(n.Pipe, fn)
+	}
+}
+
+func walkBranch(b *parse.BranchNode, fn func(parse.Node)) {
+	walkNodes(b.Pipe, fn)
+	walkNodes(b.List, fn)
+	walkNodes(b.ElseList, fn)
+}
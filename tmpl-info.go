@@ -0,0 +1,111 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TemplateInfo describes a template in the store
+type TemplateInfo struct {
+	Name string
+	// Base is the name of the template this one is based on, if any
+	Base string
+	// Source is the inline template source. It is empty for templates
+	// loaded from Filenames
+	Source    string
+	Filenames []string
+	// Root is the directory Filenames were found in: BaseDir or one of
+	// Config.ThemeDirs. It is empty for inline templates
+	Root string
+	// Blocks are the names of all templates defined in the template's set,
+	// including the ones inherited from its base
+	Blocks []string
+	// LoadedAt is when the template was last built successfully
+	LoadedAt time.Time
+	// LastError is why the last rebuild failed. It is nil if it succeeded
+	LastError error
+}
+
+// Templates returns information about every template in the store, sorted by name
+func (t *TplSys) Templates() []TemplateInfo {
+	t.store.RLock()
+	defer t.store.RUnlock()
+
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	result, err := tx.Get("tmplData", "id")
+	if err != nil {
+		return nil
+	}
+
+	var infos []TemplateInfo
+	for r := result.Next(); r != nil; r = result.Next() {
+		infos = append(infos, t.templateInfo(r.(*tmplData)))
+	}
+	return infos
+}
+
+// Template returns information about the template with "name"
+func (t *TplSys) Template(name string) (TemplateInfo, error) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return TemplateInfo{}, err
+	}
+
+	t.store.RLock()
+	defer t.store.RUnlock()
+
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	r, err := tx.First("tmplData", "id", name)
+	if err != nil {
+		return TemplateInfo{}, err
+	}
+	if r == nil {
+		return TemplateInfo{}, ErrTmplNotFound
+	}
+	return t.templateInfo(r.(*tmplData)), nil
+}
+
+// templateInfo must be called with the store (read) locked
+func (t *TplSys) templateInfo(td *tmplData) TemplateInfo {
+	info := TemplateInfo{
+		Name:      td.Name,
+		Base:      td.BaseTmplID,
+		Source:    td.Src,
+		Filenames: append([]string(nil), td.Filenames...),
+		LoadedAt:  td.LoadedAt,
+		LastError: td.LastErr,
+	}
+	if len(td.Filenames) > 0 {
+		info.Root, _ = t.fileRoot(td.Filenames[0])
+	}
+
+	if e, ok := t.store.load().get(td.Name); ok {
+		for _, b := range e.master.Templates() {
+			// component bodies are internal
+			if !strings.HasPrefix(b.Name(), "$component") {
+				info.Blocks = append(info.Blocks, b.Name())
+			}
+		}
+		sort.Strings(info.Blocks)
+	}
+	return info
+}
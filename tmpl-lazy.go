@@ -0,0 +1,235 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"html/template"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// lazyCache keeps track of the templates loaded in lazy mode and unloads the
+// least recently used ones when the store is over budget.
+// add and remove must be called with the store locked, touch is called by
+// renders and only takes the cache's own lock
+type lazyCache struct {
+	sync.Mutex
+	lru     *simplelru.LRU // key: <template name>; value: cost (int64)
+	size    int64
+	maxSize int64
+}
+
+func newLazyCache(s *tmplStore, cfg Config) *lazyCache {
+	c := &lazyCache{maxSize: cfg.MaxTemplateBytes}
+
+	count := cfg.MaxTemplates
+	if count <= 0 {
+		count = math.MaxInt32
+	}
+	lru, err := simplelru.NewLRU(count, func(key, value interface{}) {
+		// unload the template from the next version of the store
+		c.size -= value.(int64)
+		s.tmpls, _, _ = s.tmpls.Delete([]byte(key.(string)))
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.lru = lru
+	return c
+}
+
+// add records that "name" was loaded and unloads the least recently used
+// templates until the store is back in budget
+func (c *lazyCache) add(name string, cost int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if old, ok := c.lru.Peek(name); ok {
+		c.size -= old.(int64)
+	}
+	c.size += cost
+	c.lru.Add(name, cost)
+
+	// the template that was just loaded is always kept
+	for c.maxSize > 0 && c.size > c.maxSize && c.lru.Len() > 1 {
+		c.lru.RemoveOldest()
+	}
+}
+
+func (c *lazyCache) remove(name string) {
+	c.Lock()
+	c.lru.Remove(name)
+	c.Unlock()
+}
+
+// touch marks "name" as recently used
+func (c *lazyCache) touch(name string) {
+	c.Lock()
+	c.lru.Get(name)
+	c.Unlock()
+}
+
+// registerTemplate saves td without parsing it. A loaded version of the
+// template and of the templates based on it are unloaded, they are parsed
+// again from tmplData when they are next used. See saveTemplate for auto
+func (t *TplSys) registerTemplate(td *tmplData, auto bool) error {
+	t.store.Lock()
+	defer t.store.Unlock()
+
+	// make sure the base chain doesn't lead back to this template
+	if td.HasBaseTmpl {
+		err := t.checkCycle(td.Name, td.BaseTmplID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := t.saveTemplateDataToDB(td)
+	if err != nil {
+		return err
+	}
+
+	t.unloadTemplate(td.Name)
+	if auto {
+		t.publishLoaded()
+	} else {
+		t.publish()
+	}
+	return nil
+}
+
+// unloadTemplate unloads "name" and all templates based on it. It must be
+// called with the store locked
+func (t *TplSys) unloadTemplate(name string) {
+	t.store.remove(name)
+	for _, d := range t.descendantTemplates(name) {
+		t.store.remove(d)
+	}
+}
+
+// loadTemplate returns the entry with "name" and the snapshot that has it.
+// In lazy mode a template that isn't loaded is parsed from tmplData, with its
+// base templates, and a new snapshot is published
+func (t *TplSys) loadTemplate(name string) (*tmplEntry, *storeSnapshot, error) {
+	snap := t.store.load()
+	if e, ok := snap.get(name); ok {
+		return e, snap, nil
+	}
+	if t.store.lazy == nil {
+		return nil, nil, ErrTmplNotFound
+	}
+
+	t.store.Lock()
+	defer t.store.Unlock()
+
+	e, err := t.buildTemplate(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.publishLoaded()
+	return e, t.store.load(), nil
+}
+
+// buildTemplate returns the entry with "name" from the next version of the
+// store, parsing it and its base templates if they aren't loaded. It must be
+// called with the store locked
+func (t *TplSys) buildTemplate(name string) (*tmplEntry, error) {
+	if e, ok := t.store.pending(name); ok {
+		t.store.lazy.touch(name)
+		return e, nil
+	}
+
+	tx := t.store.tmplDB.Txn(false)
+	r, err := tx.First("tmplData", "id", name)
+	tx.Abort()
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ErrTmplNotFound
+	}
+	td := r.(*tmplData)
+
+	e, err := t.buildLazyEntry(td)
+	if err != nil {
+		t.setLoaded(name, err)
+		return nil, err
+	}
+	t.store.put(name, e)
+	t.setLoaded(name, nil)
+	t.store.lazy.add(name, entryCost(e))
+	return e, nil
+}
+
+// buildLazyEntry parses td on top of its base template
+func (t *TplSys) buildLazyEntry(td *tmplData) (*tmplEntry, error) {
+	var base *template.Template
+	var baseSize int64
+	rootName := td.Name
+	if td.HasBaseTmpl {
+		be, err := t.buildTemplate(td.BaseTmplID)
+		if err != nil {
+			return nil, err
+		}
+		base = be.master
+		baseSize = be.size
+		rootName = base.Name()
+	}
+
+	layer, err := t.parseLayer(td.Name, rootName, td.Src, td.Filenames)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := t.composeTemplate(base, layer)
+	if err != nil {
+		return nil, err
+	}
+	e := newTmplEntryIdle(tmpl, layer, lazyIdleRenderers)
+	e.size = baseSize + templateCost(td)
+	return e, nil
+}
+
+// lazyIdleRenderers is how many idle renderers of each kind a template keeps
+// in lazy mode, so what it holds is bounded
+const lazyIdleRenderers = 1
+
+// entryCost is what a loaded template counts against Config.MaxTemplateBytes.
+// Its master, its linked set and every renderer it can keep hold the whole
+// set: the template and its base templates
+func entryCost(e *tmplEntry) int64 {
+	copies := int64(1 + 2*lazyIdleRenderers)
+	if e.linked != nil && e.linked.tmpl != e.master {
+		copies++
+	}
+	return e.size * copies
+}
+
+// templateCost is the size of a template's own source
+func templateCost(td *tmplData) int64 {
+	if td.HasSrc {
+		return int64(len(td.Src))
+	}
+
+	var cost int64
+	for _, f := range td.Filenames {
+		if fi, err := os.Stat(f); err == nil {
+			cost += fi.Size()
+		}
+	}
+	return cost
+}
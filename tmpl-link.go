@@ -0,0 +1,353 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	helpers "github.com/bryanjeal/go-helpers"
+)
+
+// linker resolves partial calls with a constant name when a template is
+// stored. A call like
+//
+//	{{ partial "_header.html" . }}
+//
+// is replaced with
+//
+//	{{ linkedPartial "partials/_header.html" . }}
+//
+// and the partial's parse tree is added to the set under its key, so the
+// partial executes from the set instead of being looked up and cloned by
+// TplSys.Partial. A linked partial still runs as a call of its own, so when
+// it fails it is reported and handled like any other partial call.
+// Calls with a computed name, more than one context or whose result is used
+// in a pipeline, partials that define templates of their own, call "return"
+// or declare parameters, and partials that aren't in the store yet, are left
+// to TplSys.Partial.
+type linker struct {
+	t      *TplSys
+	tenant string
+	set    *template.Template
+	// deps are the entries of the partials that were linked
+	deps map[string]*tmplEntry
+	// calls are the keys the linked partial names resolved to
+	calls map[string]string
+	// used are the partials that were looked up, and whether they were
+	// missing from the store
+	used map[string]bool
+}
+
+// linkedSet is a master template with its constant partial calls linked in
+// as the tenant owning the template sees them. Renderers are cloned from it
+type linkedSet struct {
+	tmpl   *template.Template
+	tenant string
+	deps   map[string]*tmplEntry
+	calls  map[string]string
+}
+
+// publish links the changes made to the store and publishes them as a new
+// generation. It must be called with the store locked
+func (t *TplSys) publish() {
+	t.link(false)
+	t.store.publish()
+}
+
+// publishLoaded is publish for templates that were only loaded, or added on
+// first use
+func (t *TplSys) publishLoaded() {
+	t.link(true)
+	t.store.publishLoaded()
+}
+
+// link links the templates put in the store since it was last published.
+// The templates that looked up a template which changed are linked again. If
+// templates were only loaded, just the ones that found them missing are.
+// It must be called with the store locked
+func (t *TplSys) link(loaded bool) {
+	for _, name := range t.store.changed {
+		t.relinkCallers(name, "", loaded)
+		// the tenant's templates may have linked the partial it overrides
+		if tenant := keyTenant(name); tenant != "" {
+			t.relinkCallers(strings.TrimPrefix(name, tenantPrefix(tenant)), tenant, loaded)
+		}
+	}
+
+	// linking loads partials in lazy mode, which are linked in turn
+	for len(t.store.changed) > 0 {
+		names := t.store.changed
+		t.store.changed = nil
+		for _, name := range names {
+			if e, ok := t.store.pending(name); ok && e.linked == nil {
+				t.linkEntry(name, e)
+			}
+		}
+	}
+}
+
+// relinkCallers replaces the templates that looked the partial "name" up with
+// new entries to be linked. With a tenant only the templates of that tenant
+// are replaced, with missingOnly only those that found it missing
+func (t *TplSys) relinkCallers(name, tenant string, missingOnly bool) {
+	for caller, missing := range t.store.callers[name] {
+		if missingOnly && !missing || tenant != "" && keyTenant(caller) != tenant {
+			continue
+		}
+		delete(t.store.callers[name], caller)
+		e, ok := t.store.pending(caller)
+		if !ok || e.linked == nil {
+			continue
+		}
+		t.store.put(caller, e.relink())
+	}
+}
+
+// linkEntry links the partials called by the template "name" into a clone of
+// its master, taking them from the next version of the store
+func (t *TplSys) linkEntry(name string, e *tmplEntry) {
+	ls := &linkedSet{tmpl: e.master, tenant: keyTenant(name)}
+	e.linked = ls
+
+	set, err := e.master.Clone()
+	if err != nil {
+		return
+	}
+	l := &linker{
+		t:      t,
+		tenant: ls.tenant,
+		set:    set,
+		deps:   make(map[string]*tmplEntry),
+		calls:  make(map[string]string),
+		used:   make(map[string]bool),
+	}
+	for _, st := range set.Templates() {
+		if st.Tree != nil {
+			l.link(st.Tree.Root, nil)
+		}
+	}
+
+	for key, missing := range l.used {
+		t.store.addCaller(key, name, missing)
+	}
+	if len(l.deps) == 0 {
+		return
+	}
+	ls.tmpl, ls.deps, ls.calls = set, l.deps, l.calls
+
+	// the linked set is one more copy of the template to keep
+	if t.store.lazy != nil {
+		if cur, ok := t.store.pending(name); ok && cur == e {
+			t.store.lazy.add(name, entryCost(e))
+		}
+	}
+}
+
+// link rewrites the partial calls below n. stack holds the partials being
+// linked so a partial that (indirectly) calls itself stays dynamic
+func (l *linker) link(n parse.Node, stack []string) {
+	walkNodes(n, func(n parse.Node) {
+		list, ok := n.(*parse.ListNode)
+		if !ok {
+			return
+		}
+		for i, c := range list.Nodes {
+			a, ok := c.(*parse.ActionNode)
+			if !ok {
+				continue
+			}
+			name, arg, ok := linkablePartialCall(a)
+			if !ok {
+				continue
+			}
+			key := l.t.resolvePartial(l.t.store.view(), l.tenant, name)
+			if inStack(stack, key) || !l.add(key, stack) {
+				continue
+			}
+			l.calls[name] = key
+			list.Nodes[i] = linkedCall(a, key, arg)
+		}
+	})
+}
+
+// add adds the partial with "name" to the set unless it is already there.
+// It returns false if the partial can't be linked
+func (l *linker) add(name string, stack []string) bool {
+	if _, ok := l.deps[name]; ok {
+		return true
+	}
+
+	e, ok := l.t.pendingPartial(name)
+	l.used[name] = !ok
+	if !ok {
+		return false
+	}
+
+	// partials that define other templates could clash with the set
+	tmpls := e.master.Templates()
+	if len(tmpls) != 1 || tmpls[0].Tree == nil {
+		return false
+	}
+	// linked calls only render output, so a value passed to "return" would
+	// be lost, and their arguments aren't bound to parameters
+	if callsFunc(tmpls[0].Tree.Root, "return") || len(e.layer.params) > 0 {
+		return false
+	}
+
+	tree := tmpls[0].Tree.Copy()
+	_, err := l.set.AddParseTree(name, tree)
+	if err != nil {
+		return false
+	}
+	l.deps[name] = e
+
+	l.link(tree.Root, append(stack, name))
+	return true
+}
+
+// pendingPartial returns the partial with "name" from the next version of the
+// store. In lazy mode it is loaded if it isn't yet
+func (t *TplSys) pendingPartial(name string) (*tmplEntry, bool) {
+	if e, ok := t.store.pending(name); ok {
+		return e, true
+	}
+	if t.store.lazy == nil {
+		return nil, false
+	}
+	e, err := t.buildTemplate(name)
+	return e, err == nil
+}
+
+// linkablePartialCall returns the partial name and context argument (nil if
+// there is none) of an action that is nothing but a partial call with a
+// constant name
+func linkablePartialCall(a *parse.ActionNode) (string, parse.Node, bool) {
+	if a.Pipe == nil || len(a.Pipe.Decl) > 0 || len(a.Pipe.Cmds) != 1 {
+		return "", nil, false
+	}
+	cmd := a.Pipe.Cmds[0]
+	name, ok := partialCallName(cmd)
+	if !ok || len(cmd.Args) > 3 {
+		return "", nil, false
+	}
+	if len(cmd.Args) == 3 {
+		return name, cmd.Args[2], true
+	}
+	return name, nil, true
+}
+
+// linkedCall returns a {{ linkedPartial "name" arg }} node in place of a
+func linkedCall(a *parse.ActionNode, name string, arg parse.Node) *parse.ActionNode {
+	args := []parse.Node{
+		parse.NewIdentifier("linkedPartial").SetPos(a.Pos),
+		&parse.StringNode{NodeType: parse.NodeString, Pos: a.Pos, Quoted: strconv.Quote(name), Text: name},
+	}
+	if arg != nil {
+		args = append(args, arg)
+	}
+	return &parse.ActionNode{
+		NodeType: parse.NodeAction,
+		Pos:      a.Pos,
+		Line:     a.Line,
+		Pipe: &parse.PipeNode{
+			NodeType: parse.NodePipe,
+			Pos:      a.Pos,
+			Line:     a.Line,
+			Cmds: []*parse.CommandNode{{
+				NodeType: parse.NodeCommand,
+				Pos:      a.Pos,
+				Args:     args,
+			}},
+		},
+	}
+}
+
+// linkedPartial executes the partial linked into rd under "name" as part of
+// its render. It fails like a partial call
+func (t *TplSys) linkedPartial(rd *renderer, name string, ctxs []interface{}) (template.HTML, error) {
+	b, err := t.callLinked(rd, name, ctxs)
+	return t.partialOutput(rd.r, b, err)
+}
+
+// callLinked executes a linked partial and returns its output. Errors are
+// returned as a *PartialError
+func (t *TplSys) callLinked(rd *renderer, name string, ctxs []interface{}) (b []byte, err error) {
+	r := rd.r
+	defer func() {
+		if err != nil {
+			err = t.partialFailed(r, name, err)
+		}
+	}()
+
+	ctx, err := partialContext(ctxs)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.calls) >= t.maxPartialDepth() {
+		return nil, ErrPartialDepth
+	}
+
+	r.pushCall(name, nil)
+	defer r.popCall()
+
+	buf := helpers.BufferPool.Get()
+	defer helpers.BufferPool.Put(buf)
+	err = rd.tmpl.ExecuteTemplate(buf, name, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// buf is reused once it is back in the pool
+	b = make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+	return b, nil
+}
+
+// callsFunc reports if the template function fn is called anywhere below n
+func callsFunc(n parse.Node, fn string) bool {
+	found := false
+	walkNodes(n, func(n parse.Node) {
+		if id, ok := n.(*parse.IdentifierNode); ok && id.Ident == fn {
+			found = true
+		}
+	})
+	return found
+}
+
+func inStack(stack []string, name string) bool {
+	for _, s := range stack {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sees reports if the partials linked into ls are the ones r's tenant would
+// call
+func (t *TplSys) sees(ls *linkedSet, r *render) bool {
+	if r.tenant == ls.tenant {
+		return true
+	}
+	for name, key := range ls.calls {
+		if t.resolvePartial(r.snap, r.tenant, name) != key {
+			return false
+		}
+	}
+	return true
+}
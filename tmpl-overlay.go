@@ -0,0 +1,144 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"html/template"
+	"strings"
+)
+
+// Overlay is a tenant's view of a TplSys. Templates put in an overlay are
+// only visible to that tenant and are looked up before the shared templates,
+// which every overlay falls back to. Partials called while rendering through
+// an overlay are looked up the same way.
+// Overlay templates can be based on shared templates and are rebuilt when
+// those change, like any other child template.
+// They are kept in the shared store with their keys prefixed by "@<tenant>/"
+type Overlay struct {
+	t      *TplSys
+	tenant string
+}
+
+// Overlay returns the view of tenantID. Overlays are cheap, there is no need
+// to keep them around
+func (t *TplSys) Overlay(tenantID string) *Overlay {
+	return &Overlay{t: t, tenant: tenantID}
+}
+
+// tenantPrefix is the prefix of the keys of tenant's templates
+func tenantPrefix(tenant string) string {
+	return "@" + tenant + "/"
+}
+
+// keyTenant returns the tenant a template key belongs to, "" for the shared
+// store
+func keyTenant(key string) string {
+	if !strings.HasPrefix(key, "@") {
+		return ""
+	}
+	if i := strings.Index(key, "/"); i > 0 {
+		return key[1:i]
+	}
+	return ""
+}
+
+// Tenant returns the tenant ID of the overlay
+func (o *Overlay) Tenant() string {
+	return o.tenant
+}
+
+// AddTemplate adds a template to the overlay, see TplSys.AddTemplate.
+// baseTmpl is looked up in the overlay first and then in the shared store.
+// It is fine to add a template with the name of a shared one, it shadows it
+// for this tenant
+func (o *Overlay) AddTemplate(name, baseTmpl, tmplSrc string, filenames ...string) (*template.Template, error) {
+	err := o.t.checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	baseTmpl, err = o.resolveBase(baseTmpl)
+	if err != nil {
+		return nil, err
+	}
+	return o.t.AddTemplate(tenantPrefix(o.tenant)+name, baseTmpl, tmplSrc, filenames...)
+}
+
+// PutTemplate puts a template in the overlay, see TplSys.PutTemplate
+func (o *Overlay) PutTemplate(name, baseTmpl, tmplSrc string, filenames ...string) (*template.Template, error) {
+	err := o.t.checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	baseTmpl, err = o.resolveBase(baseTmpl)
+	if err != nil {
+		return nil, err
+	}
+	return o.t.PutTemplate(tenantPrefix(o.tenant)+name, baseTmpl, tmplSrc, filenames...)
+}
+
+// RemoveTemplate removes a template from the overlay, see
+// TplSys.RemoveTemplate. Shared templates can't be removed through an overlay
+func (o *Overlay) RemoveTemplate(name string, policy RemovePolicy) error {
+	err := o.t.checkName(name)
+	if err != nil {
+		return err
+	}
+	return o.t.RemoveTemplate(tenantPrefix(o.tenant)+name, policy)
+}
+
+// ExecuteTemplate executes the overlay's template with "name" or, if it has
+// none, the shared one
+func (o *Overlay) ExecuteTemplate(name string, ctx interface{}) ([]byte, error) {
+	key, err := o.resolveName(name)
+	if err != nil {
+		return nil, err
+	}
+	r := o.t.newRender(key, ctx)
+	r.tenant = o.tenant
+	return o.t.run(r, key, ctx)
+}
+
+// ExecuteTemplateCached executes the overlay's template with "name" like
+// TplSys.ExecuteTemplateCached. Pages are cached per tenant
+func (o *Overlay) ExecuteTemplateCached(name, pageKey string, ctx interface{}) ([]byte, error) {
+	key, err := o.resolveName(name)
+	if err != nil {
+		return nil, err
+	}
+	r := o.t.newRender(key, ctx)
+	r.tenant = o.tenant
+	return o.t.runCached(r, key, pageKey, ctx)
+}
+
+// resolveName resolves name in the overlay and then in the shared store
+func (o *Overlay) resolveName(name string) (string, error) {
+	err := o.t.checkName(name)
+	if err != nil {
+		return "", err
+	}
+	key, err := o.t.resolveNameIn(tenantPrefix(o.tenant), name)
+	if err != ErrTmplNotFound {
+		return key, err
+	}
+	return o.t.resolveName(name)
+}
+
+// resolveBase resolves the name of a base template, which may be empty
+func (o *Overlay) resolveBase(name string) (string, error) {
+	if o.t.checkName(name) == ErrNoName {
+		return "", nil
+	}
+	return o.resolveName(name)
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PartialParamError is returned when a partial is called with arguments that
+// don't match the parameters it declares
+type PartialParamError struct {
+	Partial string
+	// Caller is the template that called the partial
+	Caller string
+	// Param is the parameter at fault. It is empty if the call passed a
+	// context instead of named arguments
+	Param  string
+	Reason string
+}
+
+func (e *PartialParamError) Error() string {
+	if e.Param == "" {
+		return fmt.Sprintf("partial %q called from %q: %s", e.Partial, e.Caller, e.Reason)
+	}
+	return fmt.Sprintf("partial %q called from %q: parameter %q %s", e.Partial, e.Caller, e.Param, e.Reason)
+}
+
+// partialParam is a parameter declared in the header of a partial.
+// A partial declares its parameters in a comment at the very start of its
+// source, one per line:
+//
+//	{{/*
+//	@param title string required
+//	@param url string default "/"
+//	@param count int default 10
+//	*/}}
+//
+// The types are string, int, float, bool, map, slice and any. Only string,
+// int, float and bool parameters can have a default.
+// A partial that declares parameters must be called with named arguments,
+// which are checked before it is executed
+type partialParam struct {
+	name       string
+	typ        string
+	required   bool
+	hasDefault bool
+	def        interface{}
+}
+
+// paramsHeader matches a comment at the start of a template source
+var paramsHeader = regexp.MustCompile(`^\s*\{\{-?\s*/\*([\s\S]*?)\*/\s*-?\}\}`)
+
+// parseParams returns the parameters declared in the header of src
+func parseParams(src string) ([]partialParam, error) {
+	m := paramsHeader.FindStringSubmatch(src)
+	if m == nil {
+		return nil, nil
+	}
+
+	var params []partialParam
+	for _, line := range strings.Split(m[1], "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "@param ") {
+			continue
+		}
+		p, err := parseParam(strings.TrimPrefix(line, "@param "))
+		if err != nil {
+			return nil, fmt.Errorf("partial parameter %q: %v", line, err)
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// parseParam parses a "name type [required | default value]" declaration
+func parseParam(decl string) (partialParam, error) {
+	fields := strings.Fields(decl)
+	if len(fields) < 2 {
+		return partialParam{}, fmt.Errorf("expected a name and a type")
+	}
+	p := partialParam{name: fields[0], typ: fields[1]}
+	switch p.typ {
+	case "string", "int", "float", "bool", "map", "slice", "any":
+	default:
+		return p, fmt.Errorf("unknown type %q", p.typ)
+	}
+	if len(fields) == 2 {
+		return p, nil
+	}
+
+	switch fields[2] {
+	case "required":
+		if len(fields) > 3 {
+			return p, fmt.Errorf("unexpected %q", fields[3])
+		}
+		p.required = true
+	case "default":
+		// the value is the rest of the line, it may contain spaces
+		v := strings.TrimSpace(decl[strings.Index(decl, " default")+len(" default"):])
+		def, err := parseDefault(p.typ, v)
+		if err != nil {
+			return p, err
+		}
+		p.hasDefault = true
+		p.def = def
+	default:
+		return p, fmt.Errorf("unexpected %q", fields[2])
+	}
+	return p, nil
+}
+
+func parseDefault(typ, v string) (interface{}, error) {
+	switch typ {
+	case "string":
+		if s, err := strconv.Unquote(v); err == nil {
+			return s, nil
+		}
+		return v, nil
+	case "int":
+		return strconv.Atoi(v)
+	case "float":
+		return strconv.ParseFloat(v, 64)
+	case "bool":
+		return strconv.ParseBool(v)
+	}
+	return nil, fmt.Errorf("%s parameters can't have a default", typ)
+}
+
+// accepts reports if v is of the parameter's type
+func (p partialParam) accepts(v interface{}) bool {
+	if p.typ == "any" {
+		return true
+	}
+	if v == nil {
+		return false
+	}
+
+	k := reflect.ValueOf(v).Kind()
+	switch p.typ {
+	case "string":
+		return k == reflect.String
+	case "int":
+		return isInt(k)
+	case "float":
+		return k == reflect.Float32 || k == reflect.Float64 || isInt(k)
+	case "bool":
+		return k == reflect.Bool
+	case "map":
+		return k == reflect.Map
+	case "slice":
+		return k == reflect.Slice || k == reflect.Array
+	}
+	return false
+}
+
+func isInt(k reflect.Kind) bool {
+	return (k >= reflect.Int && k <= reflect.Int64) || (k >= reflect.Uint && k <= reflect.Uintptr)
+}
+
+// bindParams checks the arguments of a call against params and returns the
+// context to execute the partial with: the arguments with the defaults of
+// the missing parameters filled in. The returned error's Partial and Caller
+// are left to the caller
+func bindParams(params []partialParam, ctx interface{}) (map[string]interface{}, *PartialParamError) {
+	var args map[string]interface{}
+	switch c := ctx.(type) {
+	case nil:
+	case map[string]interface{}:
+		args = c
+	default:
+		return nil, &PartialParamError{Reason: "declares parameters and must be called with named arguments"}
+	}
+
+	bound := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		v, ok := args[p.name]
+		switch {
+		case ok && !p.accepts(v):
+			return nil, &PartialParamError{Param: p.name, Reason: fmt.Sprintf("must be %s, got %T", p.typ, v)}
+		case ok:
+			bound[p.name] = v
+		case p.required:
+			return nil, &PartialParamError{Param: p.name, Reason: "is required"}
+		case p.hasDefault:
+			bound[p.name] = p.def
+		}
+	}
+	for name := range args {
+		if _, ok := bound[name]; !ok && !declared(params, name) {
+			return nil, &PartialParamError{Param: name, Reason: "is not declared"}
+		}
+	}
+	return bound, nil
+}
+
+func declared(params []partialParam, name string) bool {
+	for _, p := range params {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
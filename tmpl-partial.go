@@ -0,0 +1,197 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultPartialExts are the extensions tried for a partial name without one
+// when Config.PartialExts isn't set
+var DefaultPartialExts = []string{".html"}
+
+// DefaultMaxPartialDepth is used when Config.MaxPartialDepth isn't set
+const DefaultMaxPartialDepth = 64
+
+// partialCache remembers which template a partial name resolved to. It is
+// emptied whenever the store publishes a new generation
+type partialCache struct {
+	sync.Mutex
+	gen   uint64
+	names map[string]string
+}
+
+func (c *partialCache) get(gen uint64, name string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen != gen {
+		return "", false
+	}
+	key, ok := c.names[name]
+	return key, ok
+}
+
+func (c *partialCache) put(gen uint64, name, key string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen != gen || c.names == nil {
+		c.gen = gen
+		c.names = make(map[string]string)
+	}
+	c.names[name] = key
+}
+
+// failureCounter counts the failed calls of each partial
+type failureCounter struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *failureCounter) add(name string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[name]++
+}
+
+// PartialErrors returns how many times each partial failed, by template key.
+// It can be published with expvar, e.g.
+//
+//	expvar.Publish("partialErrors", expvar.Func(func() interface{} {
+//		return Tpl.PartialErrors()
+//	}))
+func (t *TplSys) PartialErrors() map[string]uint64 {
+	t.failures.Lock()
+	defer t.failures.Unlock()
+	counts := make(map[string]uint64, len(t.failures.counts))
+	for k, v := range t.failures.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+// resolvePartial returns the key of the partial "name" refers to.
+// A partial can be called by its filename, e.g. "_header.html", or without
+// the extension or leading underscore, e.g. "header" or "nav/main". The
+// candidates from partialCandidates are tried in order and the first one that
+// is in the store or exists on disk wins. If none do the exact key is
+// returned so loading it reports the missing file.
+// With a tenant, its own version of each candidate is tried first
+func (t *TplSys) resolvePartial(snap *storeSnapshot, tenant, name string) string {
+	var prefix string
+	if tenant != "" {
+		prefix = tenantPrefix(tenant)
+	}
+
+	key := t.partialName(name)
+	if prefix != "" && t.storeHas(snap, prefix+key) {
+		return prefix + key
+	}
+	if _, ok := snap.get(key); ok {
+		return key
+	}
+	// the next version of the store may not resolve names like the current one
+	cache := !snap.pending
+	if cache {
+		if k, ok := t.partials.get(snap.gen, prefix+name); ok {
+			return k
+		}
+	}
+
+	for _, c := range t.partialCandidates(key) {
+		if prefix != "" && t.storeHas(snap, prefix+c) {
+			c = prefix + c
+		} else if !t.partialExists(snap, c) {
+			continue
+		}
+		if cache {
+			t.partials.put(snap.gen, prefix+name, c)
+		}
+		return c
+	}
+	return key
+}
+
+// partialCandidates returns the keys a partial key may refer to: key itself
+// and then, for every directory in Config.PartialDirs, the name as is and
+// with a leading underscore, each as is and, if it has none, with every
+// extension in Config.PartialExts
+func (t *TplSys) partialCandidates(key string) []string {
+	dir, file := path.Split(strings.TrimPrefix(key, NamespacePartial))
+
+	files := []string{file}
+	if !strings.HasPrefix(file, "_") {
+		files = append(files, "_"+file)
+	}
+	exts := []string{""}
+	if path.Ext(file) == "" {
+		if len(t.config.PartialExts) > 0 {
+			exts = append(exts, t.config.PartialExts...)
+		} else {
+			exts = append(exts, DefaultPartialExts...)
+		}
+	}
+	dirs := t.config.PartialDirs
+	if len(dirs) == 0 {
+		dirs = []string{""}
+	}
+
+	keys := []string{key}
+	seen := map[string]bool{key: true}
+	for _, d := range dirs {
+		for _, f := range files {
+			for _, e := range exts {
+				k := path.Clean(NamespacePartial + path.Join(d, dir, f+e))
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// partialExists reports if the partial with "key" is in the store or can be
+// loaded from its file
+func (t *TplSys) partialExists(snap *storeSnapshot, key string) bool {
+	if !strings.HasPrefix(key, NamespacePartial) {
+		return false
+	}
+	if t.storeHas(snap, key) {
+		return true
+	}
+
+	p, err := t.fullPath(key)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && !fi.IsDir()
+}
+
+// storeHas reports if the template with "key" is in snap or, in lazy mode,
+// registered
+func (t *TplSys) storeHas(snap *storeSnapshot, key string) bool {
+	if _, ok := snap.get(key); ok {
+		return true
+	}
+	return t.store.lazy != nil && t.hasTemplate(key) == nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"html/template"
+	"runtime"
+	"sync"
+)
+
+// rebuildJob is a descendant of a changed template that has to be put on top
+// of its parent's new master
+type rebuildJob struct {
+	td     *tmplData
+	parent *template.Template
+	// parentSet is the list of parent's templates, shared by its children
+	parentSet []*template.Template
+	e         *tmplEntry
+	err       error
+}
+
+// rebuildChildTemplates rebuilds every descendant of "name" on top of tmpl,
+// its new master. The caller must lock the store and publish afterwards.
+// Descendants are rebuilt one level of the tree at a time: the templates of a
+// level only depend on the level above, so they are rebuilt concurrently by
+// up to Config.RebuildWorkers workers. The rebuilt templates are all put in
+// the store once every level is done.
+// A template that fails to build keeps its old version and its descendants
+// aren't rebuilt. The first error is returned
+func (t *TplSys) rebuildChildTemplates(name string, tmpl *template.Template) error {
+	// make sure template name is passed
+	err := t.checkName(name)
+	if err != nil {
+		return err
+	}
+
+	// in lazy mode descendants are parsed again when they are next used
+	if t.store.lazy != nil {
+		for _, d := range t.descendantTemplates(name) {
+			t.store.remove(d)
+		}
+		return nil
+	}
+
+	// seen holds the templates already rebuilt so a cycle in the base chain
+	// can't rebuild forever
+	seen := map[string]bool{name: true}
+	level, err := t.childJobs(name, tmpl, seen, nil)
+	if err != nil {
+		return err
+	}
+
+	var done []*rebuildJob
+	var firstErr error
+	for len(level) > 0 {
+		t.runRebuildJobs(level)
+
+		var next []*rebuildJob
+		for _, j := range level {
+			done = append(done, j)
+			if j.err != nil {
+				if firstErr == nil {
+					firstErr = j.err
+				}
+				continue
+			}
+			next, err = t.childJobs(j.td.Name, j.e.master, seen, next)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		level = next
+	}
+
+	// commit the results together
+	for _, j := range done {
+		if j.err == nil {
+			t.store.put(j.td.Name, j.e)
+		}
+		t.setLoaded(j.td.Name, j.err)
+	}
+
+	return firstErr
+}
+
+// childJobs appends a job for every template based on "name" that hasn't been
+// seen yet to jobs
+func (t *TplSys) childJobs(name string, parent *template.Template, seen map[string]bool, jobs []*rebuildJob) ([]*rebuildJob, error) {
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	result, err := tx.Get("tmplData", "baseid", name)
+	if err != nil {
+		return jobs, err
+	}
+	var set []*template.Template
+	for r := result.Next(); r != nil; r = result.Next() {
+		td := r.(*tmplData)
+		if seen[td.Name] {
+			continue
+		}
+		seen[td.Name] = true
+		if set == nil {
+			set = parent.Templates()
+		}
+		jobs = append(jobs, &rebuildJob{td: td, parent: parent, parentSet: set})
+	}
+
+	return jobs, nil
+}
+
+// runRebuildJobs rebuilds jobs with a bounded number of workers.
+// The workers only read the store, results are kept in the jobs
+func (t *TplSys) runRebuildJobs(jobs []*rebuildJob) {
+	workers := t.config.RebuildWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	if workers == 1 {
+		for _, j := range jobs {
+			t.rebuild(j)
+		}
+		return
+	}
+
+	ch := make(chan *rebuildJob)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				t.rebuild(j)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		ch <- j
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// rebuild puts the template of j on top of its parent.
+// The parsed layer is reused unless the root of the base chain changed
+func (t *TplSys) rebuild(j *rebuildJob) {
+	var layer *tmplLayer
+	if e, ok := t.store.pending(j.td.Name); ok && e.layer.tmpl.Name() == j.parent.Name() {
+		layer = e.layer
+	} else {
+		layer, j.err = t.parseLayer(j.td.Name, j.parent.Name(), j.td.Src, j.td.Filenames)
+		if j.err != nil {
+			return
+		}
+	}
+
+	tmpl, err := t.composeSet(j.parent.Name(), j.parentSet, layer)
+	if err != nil {
+		j.err = err
+		return
+	}
+	j.e = newTmplEntry(tmpl, layer)
+}
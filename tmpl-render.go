@@ -0,0 +1,345 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"html/template"
+	"runtime"
+
+	helpers "github.com/bryanjeal/go-helpers"
+)
+
+// maxIdleRenderers is how many idle renderers of each kind a template keeps
+var maxIdleRenderers = 2 * runtime.NumCPU()
+
+// tmplEntry is a template in the store.
+// html/template can't clone a template once it has been executed, so master
+// is never executed and only used to build other templates on. It is
+// executed through renderers: clones of linked, or of master, that are made
+// once and then reused by one render at a time.
+// linked is master with its partials linked in. It is set when the entry is
+// stored, before it is published
+// layer is the template's own source, parsed without its base, so master can
+// be rebuilt when the base changes without parsing the source again
+type tmplEntry struct {
+	master *template.Template
+	layer  *tmplLayer
+	linked *linkedSet
+	// idle are renderers with linked partials, dynamic those without
+	idle    chan *renderer
+	dynamic chan *renderer
+	// size is the source size of the template and its base templates. It is
+	// only set in lazy mode
+	size int64
+}
+
+// tmplLayer is a template's own source parsed without its base, along with
+// the parameters it declares
+type tmplLayer struct {
+	tmpl   *template.Template
+	params []partialParam
+}
+
+func newTmplEntry(master *template.Template, layer *tmplLayer) *tmplEntry {
+	return newTmplEntryIdle(master, layer, maxIdleRenderers)
+}
+
+// newTmplEntryIdle makes an entry that keeps up to idle renderers of each kind
+func newTmplEntryIdle(master *template.Template, layer *tmplLayer, idle int) *tmplEntry {
+	return &tmplEntry{
+		master:  master,
+		layer:   layer,
+		idle:    make(chan *renderer, idle),
+		dynamic: make(chan *renderer, idle),
+	}
+}
+
+// relink returns a copy of e without the linked set or any renderers, to be
+// linked again
+func (e *tmplEntry) relink() *tmplEntry {
+	n := newTmplEntryIdle(e.master, e.layer, cap(e.idle))
+	n.size = e.size
+	return n
+}
+
+// render is the state of one ExecuteTemplate call. It is shared with the
+// partials executed by it, so they are all taken from the same snapshot of
+// the store even if a template is reloaded halfway through
+type render struct {
+	snap *storeSnapshot
+	// tenant is set when rendering through an Overlay
+	tenant string
+	// name and ctx are the template and context the render was started with
+	name string
+	ctx  interface{}
+	// calls are the partial calls in progress, innermost last
+	calls []*partialCall
+	// failed is the error of the partial call that is aborting the render
+	failed *PartialError
+	// degraded is set when a failed partial rendered the placeholder
+	degraded bool
+	// deps collects the entries executed while a partialCached call is
+	// rendering. It is nil otherwise
+	deps map[string]*tmplEntry
+	// slotDot is the dot of the slot that is about to be rendered
+	slotDot interface{}
+}
+
+// partialCall is a partial being executed. value is what it passed to
+// "return"
+type partialCall struct {
+	name  string
+	value interface{}
+	// slots are the body and slots of a component call
+	slots *slotSet
+}
+
+func (t *TplSys) newRender(name string, ctx interface{}) *render {
+	return &render{snap: t.store.load(), name: name, ctx: ctx}
+}
+
+func (r *render) pushCall(name string, slots *slotSet) *partialCall {
+	c := &partialCall{name: name, slots: slots}
+	r.calls = append(r.calls, c)
+	return c
+}
+
+// caller returns the name of the template that is executing
+func (r *render) caller() string {
+	if n := len(r.calls); n > 0 {
+		return r.calls[n-1].name
+	}
+	return r.name
+}
+
+func (r *render) popCall() {
+	r.calls = r.calls[:len(r.calls)-1]
+}
+
+// addDeps records deps as executed by the partialCached call in progress
+func (r *render) addDeps(deps map[string]*tmplEntry) {
+	if r.deps == nil {
+		return
+	}
+	for name, e := range deps {
+		r.deps[name] = e
+	}
+}
+
+// useSnap makes r use snap until the returned func is called
+func (r *render) useSnap(snap *storeSnapshot) func() {
+	old := r.snap
+	r.snap = snap
+	return func() { r.snap = old }
+}
+
+// partialError wraps the error of the partial call "name" with the calls
+// that led to it. The error of a nested call is passed up as is
+func (r *render) partialError(name string, err error) (*PartialError, bool) {
+	if r.failed != nil {
+		return r.failed, false
+	}
+
+	var stack []string
+	if r.name != "" {
+		stack = append(stack, r.name)
+	}
+	for _, c := range r.calls {
+		stack = append(stack, c.name)
+	}
+	r.failed = &PartialError{Partial: name, Stack: append(stack, name), Err: err}
+	return r.failed, true
+}
+
+// setReturn records v as the return value of the innermost partial. It is
+// ignored outside of partials
+func (r *render) setReturn(v interface{}) {
+	if n := len(r.calls); n > 0 {
+		r.calls[n-1].value = v
+	}
+}
+
+// renderer is an executable clone of a linked set, or of a master template.
+// Its template functions that need the state of the render are bound to r
+type renderer struct {
+	tmpl *template.Template
+	// deps are the entries of the partials linked into tmpl
+	deps map[string]*tmplEntry
+	r    *render
+	// idle is the pool rd goes back to
+	idle chan *renderer
+}
+
+// getRenderer returns an idle renderer for e or makes a new one. Renders get
+// one of the linked set, unless their tenant would call other partials than
+// the linked ones, so every other tenant shares them
+func (t *TplSys) getRenderer(e *tmplEntry, r *render) (*renderer, error) {
+	if t.sees(e.linked, r) {
+		return t.takeRenderer(e.idle, e.linked.tmpl, e.linked.deps)
+	}
+	return t.takeRenderer(e.dynamic, e.master, nil)
+}
+
+// takeRenderer returns an idle renderer from pool or makes a new one from tmpl
+func (t *TplSys) takeRenderer(pool chan *renderer, tmpl *template.Template, deps map[string]*tmplEntry) (*renderer, error) {
+	select {
+	case rd := <-pool:
+		return rd, nil
+	default:
+	}
+	rd, err := t.newRenderer(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	rd.deps = deps
+	rd.idle = pool
+	return rd, nil
+}
+
+// newRenderer makes a renderer from a clone of tmpl
+func (t *TplSys) newRenderer(tmpl *template.Template) (*renderer, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	rd := &renderer{tmpl: tmpl}
+	rd.tmpl.Funcs(template.FuncMap{
+		"partial": func(name string, ctxs ...interface{}) (template.HTML, error) {
+			return t.partial(rd.r, name, ctxs...)
+		},
+		"linkedPartial": func(name string, ctxs ...interface{}) (template.HTML, error) {
+			return t.linkedPartial(rd, name, ctxs)
+		},
+		"partialCached": func(name string, ctx interface{}, variants ...interface{}) (template.HTML, error) {
+			return t.partialCached(rd.r, name, ctx, variants...)
+		},
+		"component": func(name string, args ...interface{}) (template.HTML, error) {
+			return t.component(rd.r, name, args...)
+		},
+		"slots": func(prefix string, ctx, root interface{}) *slotSet {
+			return &slotSet{rd: rd, prefix: prefix, ctx: ctx, root: root, depth: len(rd.r.calls)}
+		},
+		"slotDot": func() []interface{} {
+			return []interface{}{rd.r.slotDot}
+		},
+		"slot": func(names ...string) (template.HTML, error) {
+			return t.slot(rd.r, names...)
+		},
+		"hasSlot": func(name string) bool {
+			_, tmpl := rd.r.slotTemplate(name)
+			return tmpl != nil
+		},
+		"partialValue": func(name string, ctxs ...interface{}) (interface{}, error) {
+			return t.partialValue(rd.r, name, ctxs...)
+		},
+		"return": func(v interface{}) string {
+			rd.r.setReturn(v)
+			return ""
+		},
+		"root": func() interface{} {
+			return rd.r.ctx
+		},
+	})
+	return rd, nil
+}
+
+// release keeps rd for reuse unless its pool has enough idle renderers
+func (rd *renderer) release() {
+	rd.r = nil
+	select {
+	case rd.idle <- rd:
+	default:
+	}
+}
+
+// run executes render r. If it was aborted by a partial the *PartialError is
+// returned rather than the template's error that wraps it
+func (t *TplSys) run(r *render, name string, ctx interface{}) ([]byte, error) {
+	b, err := t.execute(r, name, ctx)
+	if err != nil && r.failed != nil {
+		return nil, r.failed
+	}
+	return b, err
+}
+
+// runCached runs render r, or returns its output from the page cache under
+// key
+func (t *TplSys) runCached(r *render, name, key string, ctx interface{}) ([]byte, error) {
+	if t.pages == nil {
+		return t.run(r, name, ctx)
+	}
+
+	key = cacheKey(r.tenant, name, []interface{}{key})
+	if out, _, ok := t.pages.get(key, r.snap); ok {
+		d := make([]byte, len(out))
+		copy(d, out)
+		return d, nil
+	}
+
+	r.deps = make(map[string]*tmplEntry)
+	b, err := t.run(r, name, ctx)
+	if err != nil || r.degraded {
+		return b, err
+	}
+	// the caller owns b
+	out := make([]byte, len(b))
+	copy(out, b)
+	t.pages.put(key, out, r.deps)
+	return b, nil
+}
+
+// execute executes the template with "name" from r's snapshot
+func (t *TplSys) execute(r *render, name string, ctx interface{}) ([]byte, error) {
+	e, ok := r.snap.get(name)
+	switch {
+	case ok && t.store.lazy != nil:
+		t.store.lazy.touch(name)
+	case !ok && t.store.lazy != nil:
+		// parse it and continue with the snapshot that has it
+		_, snap, err := t.loadTemplate(name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.useSnap(snap)()
+		return t.execute(r, name, ctx)
+	case !ok:
+		return nil, ErrTmplNotFound
+	}
+
+	rd, err := t.getRenderer(e, r)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.release()
+	rd.r = r
+	if r.deps != nil {
+		r.deps[name] = e
+		r.addDeps(rd.deps)
+	}
+
+	b := helpers.BufferPool.Get()
+	defer helpers.BufferPool.Put(b)
+
+	// execute template
+	err = rd.tmpl.Execute(b, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// return a copy of the bytes, b is reused once it is back in the pool
+	d := make([]byte, b.Len())
+	copy(d, b.Bytes())
+	return d, nil
+}
@@ -16,13 +16,18 @@ package tmpl
 
 import (
 	"errors"
+	"fmt"
 	"html/template"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template/parse"
+	"time"
 
-	helpers "github.com/bryanjeal/go-helpers"
-	"github.com/fsnotify/fsnotify"
+	iradix "github.com/hashicorp/go-immutable-radix"
 	memdb "github.com/hashicorp/go-memdb"
 )
 
@@ -32,6 +37,74 @@ var (
 	ErrTmplNotFound = errors.New("template not found in store")
 	ErrTmplExists   = errors.New("template with existing name found in store")
 	ErrNoTmpl       = errors.New("no template data provided")
+	ErrTimeout      = errors.New("timed out waiting for template generation")
+	ErrTmplChildren = errors.New("template has child templates")
+	ErrPathEscapes  = errors.New("template path is outside of the base directory")
+	ErrPartialArgs  = errors.New("partial arguments must be a context or name/value pairs")
+	ErrPartialDepth = errors.New("partials are nested too deeply")
+)
+
+// CycleError is returned when a template would (indirectly) become its own
+// base template. Chain lists the templates of the cycle, starting and
+// ending with the template being saved
+type CycleError struct {
+	Chain []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("template base cycle: %s", strings.Join(e.Chain, " -> "))
+}
+
+// AmbiguousNameError is returned when a name that isn't a template key
+// matches templates in more than one namespace
+type AmbiguousNameError struct {
+	Name    string
+	Matches []string
+}
+
+func (e *AmbiguousNameError) Error() string {
+	return fmt.Sprintf("template name %q is ambiguous: %s", e.Name, strings.Join(e.Matches, ", "))
+}
+
+// PartialError is returned when a partial fails with Config.StrictPartials
+// set, or when a partialValue call fails. Stack is the chain of templates
+// that led to the partial, from the executed template to the partial itself
+type PartialError struct {
+	Partial string
+	Stack   []string
+	Err     error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("partial %q failed (%s): %v", e.Partial, strings.Join(e.Stack, " > "), e.Err)
+}
+
+// Template namespaces. Templates loaded from files are keyed by their path
+// relative to BaseDir, so the directory a template is in is its namespace.
+// Partials are always looked up in NamespacePartial
+const (
+	NamespaceContent = "content/"
+	NamespaceLayout  = "layout/"
+	NamespacePartial = "partials/"
+)
+
+// namespaces are searched in this order by resolveName
+var namespaces = []string{NamespaceContent, NamespaceLayout, NamespacePartial}
+
+// RemovePolicy decides what RemoveTemplate does with the templates based on
+// the one being removed
+type RemovePolicy int
+
+// Remove policies
+const (
+	// RemoveRestrict refuses to remove a template that has children and
+	// returns ErrTmplChildren instead
+	RemoveRestrict RemovePolicy = iota
+	// RemoveCascade removes all templates based on the template as well
+	RemoveCascade
+	// RemoveDetach turns children into root templates. They keep rendering
+	// with the removed base until they are rebuilt from their own source
+	RemoveDetach
 )
 
 // Ctx is a common context for other modules to embed/use
@@ -52,37 +125,249 @@ type EmailMessage struct {
 	TplName   string
 }
 
+// Config holds the optional settings of a TplSys. The zero value is the
+// default configuration
+type Config struct {
+	// Watcher selects how template files are watched for changes
+	Watcher WatchMode
+	// PollInterval is how often polled files are checked. Defaults to DefaultPollInterval
+	PollInterval time.Duration
+	// PollHash makes polling also compare file contents, for filesystems
+	// with coarse modification times
+	PollHash bool
+	// RebuildWorkers is how many templates are rebuilt at once when a base
+	// template changes. 1 rebuilds one template at a time. Defaults to
+	// runtime.NumCPU()
+	RebuildWorkers int
+
+	// Lazy only registers templates when they are added. A template is
+	// parsed, along with its base templates, the first time it is used and
+	// unloaded again when one of the budgets below is exceeded
+	Lazy bool
+	// MaxTemplates is how many templates Lazy keeps loaded. 0 means no limit
+	MaxTemplates int
+	// MaxTemplateBytes bounds the memory of the templates Lazy keeps loaded,
+	// measured in source bytes. A loaded template counts its base templates
+	// too, once for its master, once for its copy with linked partials if
+	// it has one and once for each renderer it can keep. Lazy keeps at most
+	// one idle renderer of each kind. 0 means no limit
+	MaxTemplateBytes int64
+
+	// FollowSymlinks allows template files to be symlinks that resolve
+	// outside of their root, e.g. to templates shared between sites. They are
+	// rejected by default. Paths that leave their root are always rejected
+	FollowSymlinks bool
+
+	// ThemeDirs are searched, in order, for template files that aren't in
+	// BaseDir. A site can override any layout or partial of a theme by
+	// putting a file with the same path in BaseDir, e.g.
+	//
+	//	Config{ThemeDirs: []string{"themes/base/", "defaults/"}}
+	ThemeDirs []string
+
+	// PartialDirs are the directories below partials/ searched, in order,
+	// for a partial. Defaults to partials/ itself
+	PartialDirs []string
+	// PartialExts are the extensions tried, in order, for a partial called
+	// without one. Defaults to DefaultPartialExts
+	PartialExts []string
+
+	// StrictPartials makes a failing partial abort the execution of the
+	// template calling it with a *PartialError. By default the failed partial
+	// renders PartialPlaceholder and the error is logged. Failures are counted
+	// in PartialErrors either way
+	StrictPartials bool
+	// PartialPlaceholder is rendered in place of a failed partial when
+	// StrictPartials isn't set
+	PartialPlaceholder template.HTML
+	// MaxPartialDepth is how deeply partial calls can nest in one execution,
+	// so a partial that keeps calling itself fails with ErrPartialDepth
+	// instead of overflowing the stack. The error aborts the execution even
+	// without StrictPartials. Defaults to DefaultMaxPartialDepth
+	MaxPartialDepth int
+
+	// PartialCacheSize is how many outputs partialCached keeps. Defaults to
+	// DefaultPartialCacheSize
+	PartialCacheSize int
+	// PartialCacheBytes is the total size of the outputs partialCached keeps.
+	// 0 means no limit
+	PartialCacheBytes int64
+	// PartialCacheTTL is how long partialCached keeps an output. 0 means
+	// until the partial, or a template it was rendered with, changes
+	PartialCacheTTL time.Duration
+
+	// PageCacheSize enables the cache of ExecuteTemplateCached, keeping up to
+	// this many pages. 0 disables it
+	PageCacheSize int
+	// PageCacheBytes is the total size of the pages kept. 0 means no limit
+	PageCacheBytes int64
+	// PageCacheTTL is how long a page is kept. 0 means until its template,
+	// or a template it was rendered with, changes
+	PageCacheTTL time.Duration
+}
+
 // TplSys is the template helper system
 type TplSys struct {
-	baseDir string
-	funcMap template.FuncMap
-	store   *tmplStore
+	baseDir  string
+	config   Config
+	funcMap  template.FuncMap
+	store    *tmplStore
+	partials *partialCache
+	failures *failureCounter
+	// partialOutputs is the partialCached cache
+	partialOutputs *outputCache
+	// pages is the ExecuteTemplateCached cache, nil if it is disabled
+	pages *outputCache
 }
 
-// tmplStore has a mutex to control access to it
-// tmpls is a map with key: <template name>; value: *template.Template
+// tmplStore has a mutex to control access to it.
+// Readers don't take it: the templates are published as immutable snapshots
+// and executing a template only loads the current one. Writers lock the store,
+// build the next version of tmpls and publish it as a new snapshot
 type tmplStore struct {
 	*sync.RWMutex
-	tmpls         map[string]*template.Template
+	snap          atomic.Value // *storeSnapshot
+	tmpls         *iradix.Tree // key: <template name>; value: *tmplEntry
 	tmplDB        *memdb.MemDB
-	tmplWatch     *fsnotify.Watcher
+	tmplWatch     fileWatcher
 	tmplWatchQuit chan bool
+	lazy          *lazyCache // nil unless Config.Lazy is set
+	// changed are the templates put or removed since the store was last
+	// published
+	changed []string
+	// callers are the templates that looked a partial up when they were
+	// linked. key: <partial name>; value: <caller name> -> whether the
+	// partial was missing
+	callers map[string]map[string]bool
+}
+
+// storeSnapshot is one version of the template store. It is never
+// modified after it is published. changed is closed when it is replaced.
+// gen only moves when templates are added, put, removed or reloaded, not
+// when they are loaded on use.
+// pending is set on a view of the next version of the store, which isn't
+// published
+type storeSnapshot struct {
+	gen     uint64
+	tmpls   *iradix.Tree
+	changed chan struct{}
+	pending bool
+}
+
+func (s *storeSnapshot) get(name string) (*tmplEntry, bool) {
+	e, ok := s.tmpls.Get([]byte(name))
+	if !ok {
+		return nil, false
+	}
+	return e.(*tmplEntry), true
+}
+
+// load returns the current snapshot
+func (s *tmplStore) load() *storeSnapshot {
+	return s.snap.Load().(*storeSnapshot)
+}
+
+// pending returns the entry with "name" from the next version of the store.
+// It must be called with the store locked
+func (s *tmplStore) pending(name string) (*tmplEntry, bool) {
+	e, ok := s.tmpls.Get([]byte(name))
+	if !ok {
+		return nil, false
+	}
+	return e.(*tmplEntry), true
+}
+
+// view returns the next version of the store as a snapshot to look templates
+// up in. It must be called with the store locked
+func (s *tmplStore) view() *storeSnapshot {
+	return &storeSnapshot{tmpls: s.tmpls, pending: true}
+}
+
+// put and remove change the next version of the store. They must be called
+// with the store locked
+func (s *tmplStore) put(name string, e *tmplEntry) {
+	s.tmpls, _, _ = s.tmpls.Insert([]byte(name), e)
+	s.changed = append(s.changed, name)
+}
+
+func (s *tmplStore) remove(name string) {
+	if s.lazy != nil {
+		s.lazy.remove(name)
+	}
+	s.tmpls, _, _ = s.tmpls.Delete([]byte(name))
+	s.changed = append(s.changed, name)
+}
+
+// addCaller records that the template "caller" looked the partial "name" up
+// when it was linked. It must be called with the store locked
+func (s *tmplStore) addCaller(name, caller string, missing bool) {
+	if s.callers[name] == nil {
+		s.callers[name] = make(map[string]bool)
+	}
+	s.callers[name][caller] = missing
+}
+
+// publish makes the changes to the store visible as a new generation. It
+// must be called with the store locked
+func (s *tmplStore) publish() {
+	s.swap(1)
+}
+
+// publishLoaded makes templates that were only loaded or unloaded in lazy
+// mode, or partials added on first use, visible without starting a new
+// generation. It must be called with the store locked
+func (s *tmplStore) publishLoaded() {
+	s.swap(0)
+}
+
+func (s *tmplStore) swap(step uint64) {
+	old, _ := s.snap.Load().(*storeSnapshot)
+	next := &storeSnapshot{tmpls: s.tmpls, changed: make(chan struct{})}
+	if old != nil {
+		next.gen = old.gen + step
+	}
+	s.snap.Store(next)
+	if old != nil {
+		close(old.changed)
+	}
 }
 
 // NewTplSys created a new template helper system
 func NewTplSys(basedir string) *TplSys {
+	return NewTplSysWithConfig(basedir, Config{})
+}
+
+// NewTplSysWithConfig creates a new template helper system with the settings in cfg
+func NewTplSysWithConfig(basedir string, cfg Config) *TplSys {
 	t := &TplSys{
-		baseDir: basedir,
+		baseDir:  basedir,
+		config:   cfg,
+		partials: &partialCache{},
+		failures: &failureCounter{},
 		store: &tmplStore{
 			RWMutex:       &sync.RWMutex{},
-			tmpls:         make(map[string]*template.Template),
+			tmpls:         iradix.New(),
 			tmplDB:        memdbMust(memdb.NewMemDB(schema)),
-			tmplWatch:     fsnotifyMust(fsnotify.NewWatcher()),
 			tmplWatchQuit: make(chan bool),
+			callers:       make(map[string]map[string]bool),
 		},
 	}
+	size := cfg.PartialCacheSize
+	if size <= 0 {
+		size = DefaultPartialCacheSize
+	}
+	t.partialOutputs = newOutputCache(size, cfg.PartialCacheBytes, cfg.PartialCacheTTL)
+	if cfg.PageCacheSize > 0 {
+		t.pages = newOutputCache(cfg.PageCacheSize, cfg.PageCacheBytes, cfg.PageCacheTTL)
+	}
+
+	if cfg.Lazy {
+		t.store.lazy = newLazyCache(t.store, cfg)
+	}
+	t.store.publish()
+	t.store.tmplWatch = t.newWatcher()
 	t.funcMap = t.genFuncMap()
-	go t.handleWatcherEvents()
+	go t.handleWatcherEvents(t.store.tmplWatch, t.store.tmplWatchQuit)
 	return t
 }
 
@@ -94,87 +379,366 @@ func (t *TplSys) BaseDir() string {
 // InitializeStore resets template store and file watcher
 // If you change Tpl.BaseDir then you MUST run InitializeStore()
 func (t *TplSys) InitializeStore() {
+	// stop the event handler before taking the lock, it may be waiting on it
+	t.store.tmplWatchQuit <- true
+
 	t.store.Lock()
-	t.store.tmpls = make(map[string]*template.Template)
+	t.store.tmpls = iradix.New()
+	t.store.changed = nil
+	t.store.callers = make(map[string]map[string]bool)
+	if t.config.Lazy {
+		t.store.lazy = newLazyCache(t.store, t.config)
+	}
 	t.store.tmplDB = memdbMust(memdb.NewMemDB(schema))
 	t.store.tmplWatch.Close()
-	t.store.tmplWatchQuit <- true
-	t.store.tmplWatch = fsnotifyMust(fsnotify.NewWatcher())
+	t.store.tmplWatch = t.newWatcher()
+	w := t.store.tmplWatch
+	t.store.publish()
 	t.store.Unlock()
 
-	go t.handleWatcherEvents()
+	go t.handleWatcherEvents(w, t.store.tmplWatchQuit)
+}
+
+// roots returns the directories template files are looked up in, in order:
+// BaseDir and then Config.ThemeDirs
+func (t *TplSys) roots() []string {
+	return append([]string{t.BaseDir()}, t.config.ThemeDirs...)
+}
+
+// fullPath returns the path of the template file filename, which is relative
+// to the roots. A filename that already starts with a root is used as is.
+// Otherwise the first root that has the file wins, and if none has it the
+// path in BaseDir is returned.
+// ErrPathEscapes is returned if the path leaves its root, or if it is a
+// symlink that resolves outside of it and Config.FollowSymlinks isn't set
+func (t *TplSys) fullPath(filename string) (string, error) {
+	roots := t.roots()
+	for _, root := range roots {
+		if root != "" && root != "./" && strings.HasPrefix(filename, root) {
+			return t.rootPath(root, filename)
+		}
+	}
+
+	var first string
+	for i, root := range roots {
+		path, err := t.rootPath(root, filename)
+		if err != nil {
+			return "", err
+		}
+		if len(roots) == 1 {
+			return path, nil
+		}
+		if i == 0 {
+			first = path
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return first, nil
+}
+
+// rootPath returns filename joined to root, confined to it
+func (t *TplSys) rootPath(root, filename string) (string, error) {
+	filename = strings.TrimPrefix(filename, root)
+	filename = strings.TrimPrefix(filename, "/")
+	path := filepath.Join(root, filename)
+
+	base := filepath.Clean(root)
+	if !withinDir(base, path) {
+		return "", ErrPathEscapes
+	}
+	if t.config.FollowSymlinks {
+		return path, nil
+	}
+
+	// files that don't exist yet can't be symlinks
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path, nil
+	}
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(realBase, real) {
+		return "", ErrPathEscapes
+	}
+	return path, nil
+}
+
+// checkFile confines a template file that is about to be read. Files are
+// checked on every read, not only when they are added: a file can be replaced
+// by a symlink later on
+func (t *TplSys) checkFile(path string) error {
+	root, ok := t.fileRoot(path)
+	if !ok {
+		return ErrPathEscapes
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), path)
+	if err != nil {
+		return err
+	}
+	_, err = t.rootPath(root, rel)
+	return err
+}
+
+// fileRoot returns the root path is in. Roots may be nested, like a theme
+// below BaseDir, so the deepest one wins
+func (t *TplSys) fileRoot(path string) (string, bool) {
+	var root string
+	found := false
+	for _, r := range t.roots() {
+		clean := filepath.Clean(r)
+		if withinDir(clean, path) && (!found || len(clean) > len(filepath.Clean(root))) {
+			root = r
+			found = true
+		}
+	}
+	return root, found
+}
+
+// withinDir reports if path is dir or below it. Both must be clean
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Generation returns the current generation of the template store. It is
+// incremented every time a template is added, put, reloaded (or fails to
+// reload) or removed. Loading a template on use in lazy mode and adding a
+// partial the first time it is called leave it as it is
+func (t *TplSys) Generation() uint64 {
+	return t.store.load().gen
+}
+
+// WaitForGeneration blocks until the store reaches generation n. It returns
+// ErrTimeout if that doesn't happen within timeout.
+// Use it in tests to wait for the watcher to apply a change:
+//
+//	gen := Tpl.Generation()
+//	// ... write template file ...
+//	err := Tpl.WaitForGeneration(gen+1, time.Second)
+func (t *TplSys) WaitForGeneration(n uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		snap := t.store.load()
+		if snap.gen >= n {
+			return nil
+		}
+
+		select {
+		case <-snap.changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
 }
 
 // AddTemplate will add a *template.Template to Tpl.store with "name".
 // If baseTmpl is not empty then find baseTmpl in store and clone it. Proceed as usual.
-// If store already has a template with "name" then an error will be returned
+// baseTmpl may be given without its namespace, see ExecuteTemplate
+// If store already has a template with "name" then an error will be returned.
+// In lazy mode the template is only registered and nil is returned, it is
+// parsed the first time it is used
 func (t *TplSys) AddTemplate(name, baseTmpl, tmplSrc string, filenames ...string) (*template.Template, error) {
 	// make sure a template with the same name doesn't exist
-	_, err := t.getTemplate(name)
+	err := t.hasTemplate(name)
 	if err == nil {
 		return nil, ErrTmplExists
 	} else if err != ErrTmplNotFound {
 		return nil, err
 	}
 
-	tmpl, err := t.saveTemplate(name, baseTmpl, true, tmplSrc, filenames...)
+	tmpl, err := t.saveTemplate(name, baseTmpl, true, false, tmplSrc, filenames...)
 	return tmpl, err
 }
 
 // PutTemplate will put a *template.Template to Tpl.store with "name".
-// Unlike AddTemplate this will override existing templates
+// Unlike AddTemplate this will override existing templates.
+// Templates based on it are rebuilt. One that fails to rebuild keeps its old
+// version and the first such error is returned, the template itself is put
+// all the same
 func (t *TplSys) PutTemplate(name, baseTmpl, tmplSrc string, filenames ...string) (*template.Template, error) {
 	// try and get template. If one exists then isNew is false
 	isNew := false
-	_, err := t.getTemplate(name)
+	err := t.hasTemplate(name)
 	if err == ErrTmplNotFound {
 		isNew = true
 	} else if err != nil {
 		return nil, err
 	}
 
-	tmpl, err := t.saveTemplate(name, baseTmpl, isNew, tmplSrc, filenames...)
+	tmpl, err := t.saveTemplate(name, baseTmpl, isNew, false, tmplSrc, filenames...)
 	return tmpl, err
 }
 
-// ExecuteTemplate will find the template with "name" and execute it with the provided context
-// If template with "name" doesn't exist then an error will be returned
-func (t *TplSys) ExecuteTemplate(name string, ctx interface{}) ([]byte, error) {
-	tmpl, err := t.getTemplate(name)
+// RemoveTemplate will remove the template with "name" from the store and
+// stop watching its files. policy decides what happens to templates based on it
+func (t *TplSys) RemoveTemplate(name string, policy RemovePolicy) error {
+	err := t.hasTemplate(name)
+	if err != nil {
+		return err
+	}
+
+	t.store.Lock()
+	defer t.store.Unlock()
+
+	children, err := t.childTemplates(name)
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case RemoveRestrict:
+		if len(children) > 0 {
+			return ErrTmplChildren
+		}
+	case RemoveCascade:
+		for _, c := range t.descendantTemplates(name) {
+			err = t.deleteTemplate(c)
+			if err != nil {
+				return err
+			}
+		}
+	case RemoveDetach:
+		for _, c := range children {
+			err = t.detachTemplate(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = t.deleteTemplate(name)
+	if err != nil {
+		return err
+	}
+
+	t.publish()
+	return nil
+}
+
+// childTemplates returns the names of the templates directly based on "name"
+func (t *TplSys) childTemplates(name string) ([]string, error) {
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	result, err := tx.Get("tmplData", "baseid", name)
 	if err != nil {
 		return nil, err
 	}
 
-	b := helpers.BufferPool.Get()
-	defer helpers.BufferPool.Put(b)
+	var names []string
+	for r := result.Next(); r != nil; r = result.Next() {
+		names = append(names, r.(*tmplData).Name)
+	}
+	return names, nil
+}
+
+// descendantTemplates returns the names of all templates based on "name",
+// directly or through other templates, parents before their children
+func (t *TplSys) descendantTemplates(name string) []string {
+	var names []string
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		children, _ := t.childTemplates(queue[0])
+		queue = queue[1:]
+		for _, c := range children {
+			if seen[c] {
+				continue
+			}
+			seen[c] = true
+			names = append(names, c)
+			queue = append(queue, c)
+		}
+	}
+	return names
+}
 
-	// execute template
-	err = template.Must(tmpl.Clone()).Execute(b, ctx)
+// ExecuteTemplate will find the template with "name" and execute it with the provided context
+// If template with "name" doesn't exist then an error will be returned.
+// name is a template key, e.g. "content/index.html", or a name that is unique
+// across the namespaces, e.g. "index.html"
+func (t *TplSys) ExecuteTemplate(name string, ctx interface{}) ([]byte, error) {
+	name, err := t.resolveName(name)
 	if err != nil {
 		return nil, err
 	}
+	return t.run(t.newRender(name, ctx), name, ctx)
+}
 
-	// return bytes
-	return b.Bytes(), nil
+// ExecuteTemplateCached executes the template with "name" like ExecuteTemplate
+// and keeps the result in the page cache under name and key. Later calls with
+// the same key return it without executing the template, until the template,
+// a template it is based on or a partial it called changes.
+// The context isn't part of the key, pages that render differently must use
+// different keys, e.g. the request path. Without Config.PageCacheSize it is
+// the same as ExecuteTemplate
+func (t *TplSys) ExecuteTemplateCached(name, key string, ctx interface{}) ([]byte, error) {
+	name, err := t.resolveName(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.runCached(t.newRender(name, ctx), name, key, ctx)
 }
 
+// getTemplate returns the master template with "name" for building other
+// templates on. It must not be executed
 func (t *TplSys) getTemplate(name string) (*template.Template, error) {
 	err := t.checkName(name)
 	if err != nil {
 		return nil, err
 	}
 
-	t.store.RLock()
-	defer t.store.RUnlock()
-	tmpl, ok := t.store.tmpls[name]
+	e, ok := t.store.load().get(name)
 	if !ok {
-		return nil, ErrTmplNotFound
+		if t.store.lazy == nil {
+			return nil, ErrTmplNotFound
+		}
+		e, _, err = t.loadTemplate(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.master, nil
+}
+
+// hasTemplate returns ErrTmplNotFound if there is no template with "name".
+// Unlike getTemplate it doesn't load the template in lazy mode
+func (t *TplSys) hasTemplate(name string) error {
+	err := t.checkName(name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := t.store.load().get(name); ok {
+		return nil
+	}
+	if t.store.lazy == nil {
+		return ErrTmplNotFound
 	}
 
-	return tmpl, nil
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+	r, err := tx.First("tmplData", "id", name)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return ErrTmplNotFound
+	}
+	return nil
 }
 
-func (t *TplSys) saveTemplate(name, baseTmpl string, isNew bool, tmplSrc string, filenames ...string) (*template.Template, error) {
+// saveTemplate parses and stores a template. auto is set for partials that
+// are added the first time they are called, they don't start a new generation
+func (t *TplSys) saveTemplate(name, baseTmpl string, isNew, auto bool, tmplSrc string, filenames ...string) (*template.Template, error) {
 	err := t.checkName(name)
 	if err != nil {
 		return nil, err
@@ -182,19 +746,16 @@ func (t *TplSys) saveTemplate(name, baseTmpl string, isNew bool, tmplSrc string,
 
 	// check baseTmpl name
 	// if one isn't passed then create a new template
-	// otherwise get baseTmpl and clone it
-	var tmpl *template.Template
+	// otherwise get baseTmpl and build on a clone of it
+	var base *template.Template
 	hasBaseTmpl := false
 	err = t.checkName(baseTmpl)
-	if err == ErrNoName {
-		tmpl = template.New(name).Funcs(t.funcMap)
-	} else {
+	if err != ErrNoName {
 		hasBaseTmpl = true
-		tmpl, err = t.getTemplate(baseTmpl)
-		if err != nil {
-			return nil, err
+		baseTmpl, err = t.resolveName(baseTmpl)
+		if err == nil && t.store.lazy == nil {
+			base, err = t.getTemplate(baseTmpl)
 		}
-		tmpl, err = tmpl.Clone()
 		if err != nil {
 			return nil, err
 		}
@@ -207,52 +768,94 @@ func (t *TplSys) saveTemplate(name, baseTmpl string, isNew bool, tmplSrc string,
 		if len(filenames) == 0 {
 			return nil, ErrNoTmpl
 		}
-		// clean filenames
+		// resolve filenames, leaving the caller's slice alone
+		paths := make([]string, len(filenames))
 		for i, f := range filenames {
-			f = strings.TrimPrefix(f, t.BaseDir())
-			f = strings.TrimPrefix(f, "/")
-			f = filepath.Join(t.BaseDir(), f)
-			filenames[i] = f
+			paths[i], err = t.fullPath(f)
+			if err != nil {
+				return nil, err
+			}
 		}
-		// parse the files
-		tmpl, err = tmpl.ParseFiles(filenames...)
+		filenames = paths
 	} else {
 		hasSrc = true
-		tmpl, err = tmpl.Parse(tmplSrc)
 	}
+
+	td := &tmplData{
+		Name:        name,
+		BaseTmplID:  baseTmpl,
+		Src:         tmplSrc,
+		Filenames:   filenames,
+		HasSrc:      hasSrc,
+		HasBaseTmpl: hasBaseTmpl,
+	}
+	if t.store.lazy != nil {
+		return nil, t.registerTemplate(td, auto)
+	}
+
+	// parse the template's own source and put it on top of its base
+	rootName := name
+	if base != nil {
+		rootName = base.Name()
+	}
+	layer, err := t.parseLayer(name, rootName, tmplSrc, filenames)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := t.composeTemplate(base, layer)
 	if err != nil {
 		return nil, err
 	}
+	e := newTmplEntry(tmpl, layer)
 
 	// add template to template store
 	t.store.Lock()
 	defer t.store.Unlock()
 
-	// store template
-	t.store.tmpls[name] = tmpl
+	// make sure the base chain doesn't lead back to this template
+	if hasBaseTmpl {
+		err = t.checkCycle(name, baseTmpl)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// push template data to tmplDB
-	err = t.saveTemplateDataToDB(&tmplData{
-		Name:        name,
-		BaseTmplID:  baseTmpl,
-		Src:         tmplSrc,
-		Filenames:   filenames,
-		HasSrc:      hasSrc,
-		HasBaseTmpl: hasBaseTmpl,
-	})
+	// push template data to tmplDB before the store changes, so a failure
+	// leaves both as they were
+	td.LoadedAt = time.Now()
+	err = t.saveTemplateDataToDB(td)
 	if err != nil {
 		return nil, err
 	}
 
-	// if template isn't new then rebuild all children templates
+	// store template
+	t.store.put(name, e)
+
+	// if template isn't new then rebuild all children templates. Like a
+	// reload by the watcher, the template is saved even if some of them fail
+	// and those keep their old version
 	if isNew == false {
 		err = t.rebuildChildTemplates(name, tmpl)
-		if err != nil {
-			return nil, err
-		}
 	}
 
-	return tmpl, nil
+	if auto {
+		t.publishLoaded()
+	} else {
+		t.publish()
+	}
+	return tmpl, err
+}
+
+// checkCycle returns a *CycleError if basing "name" on baseTmpl creates a
+// cycle. It must be called with the store locked
+func (t *TplSys) checkCycle(name, baseTmpl string) error {
+	chain := append([]string{name, baseTmpl}, t.ancestorTemplates(baseTmpl)...)
+	for i, n := range chain[1:] {
+		if n == name {
+			return &CycleError{Chain: chain[:i+2]}
+		}
+	}
+	return nil
 }
 
 func (t *TplSys) checkName(name string) error {
@@ -262,52 +865,147 @@ func (t *TplSys) checkName(name string) error {
 	return nil
 }
 
-// rebuildChildTemplates will be called recursively, so we don't lock the store
-// the initial call to this function should take care of locking
-func (t *TplSys) rebuildChildTemplates(name string, tmpl *template.Template) error {
-	// make sure template name is passed
-	err := t.checkName(name)
-	if err != nil {
-		return err
+// resolveName returns the key of the template "name" refers to. A key is used
+// as is. Otherwise name is looked up in every namespace and has to match
+// exactly one template, an *AmbiguousNameError is returned if it matches more
+func (t *TplSys) resolveName(name string) (string, error) {
+	return t.resolveNameIn("", name)
+}
+
+// resolveNameIn resolves name among the templates whose keys start with
+// prefix, see resolveName. The returned key includes prefix
+func (t *TplSys) resolveNameIn(prefix, name string) (string, error) {
+	err := t.hasTemplate(prefix + name)
+	if err != ErrTmplNotFound {
+		return prefix + name, err
 	}
 
-	// get all subtemplates that are based on this one
-	tx := t.store.tmplDB.Txn(false)
-	result, err := tx.Get("tmplData", "baseid", name)
-	if err != nil {
-		return err
+	var matches []string
+	for _, ns := range namespaces {
+		if t.hasTemplate(prefix+ns+name) == nil {
+			matches = append(matches, prefix+ns+name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", ErrTmplNotFound
+	case 1:
+		return matches[0], nil
 	}
+	return "", &AmbiguousNameError{Name: name, Matches: matches}
+}
 
-	// iterate over child templates and rebuild
-	for r := result.Next(); r != nil; r = result.Next() {
-		td := r.(*tmplData)
-		ctmpl, err := tmpl.Clone()
+// parseLayer parses the own source of the template with "name", tmplSrc or
+// else filenames, into a standalone set. rootName is the name of the set the
+// source will be added to, so top level content replaces the body of the base
+// template just like Parse on a clone of it would.
+// Each file is named by its key, so files with the same base name in
+// different directories don't replace each other or a template of the base.
+// The file keyed rootName is the root of the set, and so is the first file
+// with the same base name as a template without a base.
+// The parameters declared by the source, or the first file, are parsed too
+func (t *TplSys) parseLayer(name, rootName, tmplSrc string, filenames []string) (*tmplLayer, error) {
+	layer := template.New(rootName).Funcs(t.funcMap)
+	if len(tmplSrc) > 0 {
+		params, err := parseParams(tmplSrc)
+		if err != nil {
+			return nil, err
+		}
+		_, err = layer.Parse(tmplSrc)
+		if err != nil {
+			return nil, err
+		}
+		err = rewriteComponents(layer)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		return &tmplLayer{tmpl: layer, params: params}, nil
+	}
+	if len(filenames) == 0 {
+		return nil, ErrNoTmpl
+	}
+
+	var params []partialParam
+	hasRoot := false
+	for i, f := range filenames {
+		err := t.checkFile(f)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			params, err = parseParams(string(b))
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		// make sure template data or file(s) are passed
-		if td.HasSrc {
-			ctmpl, err = ctmpl.Parse(td.Src)
+		key, err := t.fileKey(f)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := layer
+		if key == rootName || !hasRoot && name == rootName && filepath.Base(f) == name {
+			hasRoot = true
 		} else {
-			ctmpl, err = ctmpl.ParseFiles(td.Filenames...)
+			tmpl = layer.New(key)
 		}
+		_, err = tmpl.Parse(string(b))
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
+	err := rewriteComponents(layer)
+	if err != nil {
+		return nil, err
+	}
+	return &tmplLayer{tmpl: layer, params: params}, nil
+}
 
-		// put template in store
-		t.store.tmpls[td.Name] = ctmpl
+// composeTemplate returns a master template made of the parse trees of base
+// (which may be nil) with the parse trees of layer added on top. The trees are
+// copied into a new set instead of cloning base: Clone holds base's lock for
+// the whole copy, and the children of a base are composed onto it
+// concurrently. Neither base nor layer are modified
+func (t *TplSys) composeTemplate(base *template.Template, layer *tmplLayer) (*template.Template, error) {
+	if base == nil {
+		return t.composeSet(layer.tmpl.Name(), nil, layer)
+	}
+	return t.composeSet(base.Name(), base.Templates(), layer)
+}
 
-		// rebuild all child templates
-		err = t.rebuildChildTemplates(td.Name, ctmpl)
+// composeSet is composeTemplate for a base set named "name" made of the
+// templates in base. Listing a set's templates takes its lock too, so
+// siblings share the list of their parent's templates
+func (t *TplSys) composeSet(name string, base []*template.Template, layer *tmplLayer) (*template.Template, error) {
+	tmpl := template.New(name).Funcs(t.funcMap)
+	for _, bt := range base {
+		if bt.Tree == nil {
+			continue
+		}
+		_, err := tmpl.AddParseTree(bt.Name(), bt.Tree.Copy())
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, lt := range layer.tmpl.Templates() {
+		if lt.Tree == nil {
+			continue
+		}
+		// an empty template doesn't replace an existing one
+		if parse.IsEmptyTree(lt.Tree.Root) && tmpl.Lookup(lt.Name()) != nil {
+			continue
+		}
+		_, err := tmpl.AddParseTree(lt.Name(), lt.Tree.Copy())
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	// noop for "Read" transaction but included so I don't go WTF later.
-	tx.Commit()
-
-	return nil
+	// AddParseTree replaces the root's entry in the set when the layer has
+	// top level content
+	return tmpl.Lookup(tmpl.Name()), nil
 }
@@ -15,9 +15,11 @@
 package tmpl
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -223,13 +225,17 @@ func TestTemplate(t *testing.T) {
 		}
 
 		// change base template by updating the html file
+		gen := Tpl.Generation()
 		err = ioutil.WriteFile(filepath.Join(Tpl.BaseDir(), "layout", "_base.html"), []byte(strings.Replace(baseHTML, "{{ partial \"_footer.html\" . }}", "", -1)), 0644)
 		if err != nil {
 			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
 		}
 
 		// index
-		time.Sleep(1 * time.Second)
+		err = Tpl.WaitForGeneration(gen+1, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Expected the watcher to rebuild the template. Instead got the error: %v", err)
+		}
 		d, err = Tpl.ExecuteTemplate("index.html", tTmplData)
 		if err != nil {
 			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
@@ -274,6 +280,1832 @@ func TestTemplate(t *testing.T) {
 	}
 }
 
+func TestWatchDir(t *testing.T) {
+	testWatchDir(t, Config{})
+}
+
+func TestWatchDirPolling(t *testing.T) {
+	testWatchDir(t, Config{Watcher: WatchPoll, PollInterval: 20 * time.Millisecond})
+}
+
+func testWatchDir(t *testing.T, cfg Config) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	Tpl := NewTplSysWithConfig(dir+"/", cfg)
+
+	err = os.MkdirAll(filepath.Join(dir, "layout"), 0777)
+	if err != nil {
+		t.Fatalf("Expected to make a layout directory. Instead got the error: %v", err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "content"), 0777)
+	if err != nil {
+		t.Fatalf("Expected to make a content directory. Instead got the error: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "layout", "_base.html"), []byte(`<main>{{ block "content" . }}{{ end }}</main>`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "content", "index.html"), []byte(`{{ define "content" }}index{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+
+	err = Tpl.WatchDir("layout", "")
+	if err != nil {
+		t.Fatalf("Expected to watch the layout directory. Instead got the error: %v", err)
+	}
+	err = Tpl.WatchDir("content", "_base.html")
+	if err != nil {
+		t.Fatalf("Expected to watch the content directory. Instead got the error: %v", err)
+	}
+
+	d, err := Tpl.ExecuteTemplate("index.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "<main>index</main>" {
+		t.Fatalf("Expected \"<main>index</main>\". Instead got: %q", d)
+	}
+
+	// changes are picked up
+	err = ioutil.WriteFile(filepath.Join(dir, "content", "index.html"), []byte(`{{ define "content" }}new index{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	waitFor(t, func() bool {
+		d, err := Tpl.ExecuteTemplate("index.html", nil)
+		return err == nil && string(d) == "<main>new index</main>"
+	})
+
+	// a new page is picked up
+	err = ioutil.WriteFile(filepath.Join(dir, "content", "about.html"), []byte(`{{ define "content" }}about{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	waitFor(t, func() bool {
+		d, err := Tpl.ExecuteTemplate("about.html", nil)
+		return err == nil && string(d) == "<main>about</main>"
+	})
+
+	// and a deleted one is dropped
+	err = os.Remove(filepath.Join(dir, "content", "about.html"))
+	if err != nil {
+		t.Fatalf("Expected to remove test template. Instead got the error: %v", err)
+	}
+	waitFor(t, func() bool {
+		_, err := Tpl.getTemplate("about.html")
+		return err == ErrTmplNotFound
+	})
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// poll so rarely that only Reload can pick up the change
+	Tpl := NewTplSysWithConfig(dir+"/", Config{Watcher: WatchPoll, PollInterval: time.Hour})
+
+	err = ioutil.WriteFile(filepath.Join(dir, "_base.html"), []byte(`<main>{{ block "content" . }}{{ end }}</main>`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("_base.html", "", "", "_base.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("index.html", "_base.html", `{{ define "content" }}index{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	gen := Tpl.Generation()
+	err = ioutil.WriteFile(filepath.Join(dir, "_base.html"), []byte(`<div>{{ block "content" . }}{{ end }}</div>`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	err = Tpl.Reload("_base.html")
+	if err != nil {
+		t.Fatalf("Expected to reload the template. Instead got the error: %v", err)
+	}
+	if Tpl.Generation() != gen+1 {
+		t.Fatalf("Expected generation %d. Instead got: %d", gen+1, Tpl.Generation())
+	}
+	err = Tpl.WaitForGeneration(gen+1, 0)
+	if err != nil {
+		t.Fatalf("Expected generation to be reached. Instead got the error: %v", err)
+	}
+	err = Tpl.WaitForGeneration(gen+2, 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout. Instead got: %v", err)
+	}
+
+	d, err := Tpl.ExecuteTemplate("index.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "<div>index</div>" {
+		t.Fatalf("Expected \"<div>index</div>\". Instead got: %q", d)
+	}
+}
+
+func TestGenerationOnUse(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "partials"), 0777)
+	if err != nil {
+		t.Fatalf("Expected to make a partials directory. Instead got the error: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "partials", "_header.html"), []byte("header"), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+
+	for _, lazy := range []bool{false, true} {
+		Tpl := NewTplSysWithConfig(dir+"/", Config{Lazy: lazy})
+		_, err := Tpl.AddTemplate("index.html", "", `{{ partial "_header.html" . }}`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+
+		// the partial is added and, in lazy mode, both templates are loaded
+		gen := Tpl.Generation()
+		d, err := Tpl.ExecuteTemplate("index.html", nil)
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != "header" {
+			t.Fatalf("Expected \"header\". Instead got: %q", d)
+		}
+		if Tpl.Generation() != gen {
+			t.Fatalf("Expected generation %d (lazy %v). Instead got: %d", gen, lazy, Tpl.Generation())
+		}
+	}
+}
+
+func TestRemoveTemplate(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	setup := func(t *testing.T) {
+		Tpl.InitializeStore()
+		_, err := Tpl.AddTemplate("_base.html", "", `<main>{{ block "content" . }}{{ end }}</main>`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		_, err = Tpl.AddTemplate("_section.html", "_base.html", `{{ define "content" }}<section>{{ block "section" . }}{{ end }}</section>{{ end }}`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		_, err = Tpl.AddTemplate("index.html", "_section.html", `{{ define "section" }}index{{ end }}`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	t.Run("Restrict", func(t *testing.T) {
+		setup(t)
+		err := Tpl.RemoveTemplate("_section.html", RemoveRestrict)
+		if err != ErrTmplChildren {
+			t.Fatalf("Expected ErrTmplChildren. Instead got: %v", err)
+		}
+		err = Tpl.RemoveTemplate("index.html", RemoveRestrict)
+		if err != nil {
+			t.Fatalf("Expected to remove template. Instead got the error: %v", err)
+		}
+		_, err = Tpl.getTemplate("index.html")
+		if err != ErrTmplNotFound {
+			t.Fatalf("Expected ErrTmplNotFound. Instead got: %v", err)
+		}
+		err = Tpl.RemoveTemplate("index.html", RemoveRestrict)
+		if err != ErrTmplNotFound {
+			t.Fatalf("Expected ErrTmplNotFound. Instead got: %v", err)
+		}
+	})
+
+	t.Run("Cascade", func(t *testing.T) {
+		setup(t)
+		err := Tpl.RemoveTemplate("_base.html", RemoveCascade)
+		if err != nil {
+			t.Fatalf("Expected to remove template. Instead got the error: %v", err)
+		}
+		for _, name := range []string{"_base.html", "_section.html", "index.html"} {
+			_, err = Tpl.getTemplate(name)
+			if err != ErrTmplNotFound {
+				t.Fatalf("Expected %q to be removed. Instead got: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Detach", func(t *testing.T) {
+		setup(t)
+		err := Tpl.RemoveTemplate("_section.html", RemoveDetach)
+		if err != nil {
+			t.Fatalf("Expected to remove template. Instead got the error: %v", err)
+		}
+
+		// the child still renders and is no longer rebuilt with its old base name
+		_, err = Tpl.AddTemplate("_section.html", "", `<p>{{ block "section" . }}{{ end }}</p>`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		_, err = Tpl.PutTemplate("_section.html", "", `<p>{{ block "section" . }}{{ end }}</p>`)
+		if err != nil {
+			t.Fatalf("Expected to put template to store. Instead got the error: %v", err)
+		}
+		d, err := Tpl.ExecuteTemplate("index.html", nil)
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != "<main><section>index</section></main>" {
+			t.Fatalf("Expected the detached template to keep its content. Instead got: %q", d)
+		}
+	})
+
+	// a file stays watched while another template is parsed from it
+	t.Run("SharedFile", func(t *testing.T) {
+		dir, err := ioutil.TempDir(".", "testData-")
+		if err != nil {
+			t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		for name, src := range map[string]string{"x.html": "old", "b.html": `b {{ template "x.html" }}`} {
+			err = ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+			if err != nil {
+				t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+			}
+		}
+		Tpl := NewTplSysWithConfig(dir+"/", Config{Watcher: WatchPoll, PollInterval: 10 * time.Millisecond})
+		_, err = Tpl.AddTemplate("x.html", "", "", "x.html")
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		_, err = Tpl.AddTemplate("b.html", "", "", "b.html", "x.html")
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+
+		err = Tpl.RemoveTemplate("x.html", RemoveRestrict)
+		if err != nil {
+			t.Fatalf("Expected to remove template. Instead got the error: %v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "x.html"), []byte("new"), 0644)
+		if err != nil {
+			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+		}
+		waitFor(t, func() bool {
+			d, err := Tpl.ExecuteTemplate("b.html", nil)
+			return err == nil && string(d) == "b new"
+		})
+	})
+}
+
+func TestTemplateInfo(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	Tpl := NewTplSysWithConfig(dir+"/", Config{Watcher: WatchPoll, PollInterval: time.Hour})
+
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(`{{ define "content" }}index{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("_base.html", "", `<main>{{ block "content" . }}{{ end }}</main>`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("index.html", "_base.html", "", "index.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	infos := Tpl.Templates()
+	if len(infos) != 2 || infos[0].Name != "_base.html" || infos[1].Name != "index.html" {
+		t.Fatalf("Expected _base.html and index.html. Instead got: %+v", infos)
+	}
+
+	info, err := Tpl.Template("index.html")
+	if err != nil {
+		t.Fatalf("Expected to get template info. Instead got the error: %v", err)
+	}
+	if info.Base != "_base.html" || info.Source != "" || len(info.Filenames) != 1 || info.LoadedAt.IsZero() || info.LastError != nil {
+		t.Fatalf("Expected info for a file based template. Instead got: %+v", info)
+	}
+	if strings.Join(info.Blocks, ",") != "_base.html,content,index.html" {
+		t.Fatalf("Expected blocks _base.html, content and index.html. Instead got: %v", info.Blocks)
+	}
+
+	// a broken change is reported but the old template is kept
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(`{{ define "content" }}index`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	err = Tpl.Reload("index.html")
+	if err == nil {
+		t.Fatalf("Expected a parse error.")
+	}
+	info, err = Tpl.Template("index.html")
+	if err != nil {
+		t.Fatalf("Expected to get template info. Instead got the error: %v", err)
+	}
+	if info.LastError == nil {
+		t.Fatalf("Expected the parse error to be recorded.")
+	}
+	_, err = Tpl.ExecuteTemplate("index.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the old template. Instead got the error: %v", err)
+	}
+
+	_, err = Tpl.Template("missing.html")
+	if err != ErrTmplNotFound {
+		t.Fatalf("Expected ErrTmplNotFound. Instead got: %v", err)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	_, err := Tpl.AddTemplate("_base.html", "", `{{ partial "_header.html" . }}<main>{{ block "content" . }}{{ end }}</main>`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("index.html", "_base.html", `{{ define "content" }}{{ block "section" . }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("about.html", "index.html", `{{ define "section" }}{{ partial "partials/_team.html" . }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	ancestors, err := Tpl.Ancestors("about.html")
+	if err != nil {
+		t.Fatalf("Expected to get ancestors. Instead got the error: %v", err)
+	}
+	if strings.Join(ancestors, ",") != "index.html,_base.html" {
+		t.Fatalf("Expected index.html and _base.html. Instead got: %v", ancestors)
+	}
+
+	descendants, err := Tpl.Descendants("_base.html")
+	if err != nil {
+		t.Fatalf("Expected to get descendants. Instead got the error: %v", err)
+	}
+	if strings.Join(descendants, ",") != "index.html,about.html" {
+		t.Fatalf("Expected index.html and about.html. Instead got: %v", descendants)
+	}
+
+	_, err = Tpl.Ancestors("missing.html")
+	if err != ErrTmplNotFound {
+		t.Fatalf("Expected ErrTmplNotFound. Instead got: %v", err)
+	}
+
+	g := Tpl.Graph()
+	dot := g.DOT()
+	for _, line := range []string{
+		`"about.html" -> "index.html" [label="base"];`,
+		`"about.html" -> "partials/_team.html" [label="partial", style=dashed];`,
+		`"_base.html" -> "partials/_header.html" [label="partial", style=dashed];`,
+		`"partials/_team.html" [style=dashed];`,
+	} {
+		if !strings.Contains(dot, line) {
+			t.Fatalf("Expected DOT output to contain %s. Instead got:\n%s", line, dot)
+		}
+	}
+	// descendants don't repeat the partial calls of their base
+	for _, line := range []string{
+		`"index.html" -> "partials/_header.html"`,
+		`"about.html" -> "partials/_header.html"`,
+	} {
+		if strings.Contains(dot, line) {
+			t.Fatalf("Expected DOT output not to contain %s. Instead got:\n%s", line, dot)
+		}
+	}
+
+	b, err := g.JSON()
+	if err != nil {
+		t.Fatalf("Expected to encode the graph. Instead got the error: %v", err)
+	}
+	if !strings.Contains(string(b), `{"from":"index.html","to":"_base.html","kind":"base"}`) {
+		t.Fatalf("Expected JSON output to contain the index.html base edge. Instead got: %s", b)
+	}
+
+	// templates that aren't loaded yet are parsed for their edges
+	t.Run("Lazy", func(t *testing.T) {
+		Tpl := NewTplSysWithConfig("./", Config{Lazy: true})
+		_, err := Tpl.AddTemplate("index.html", "", `{{ partial "_header.html" . }}`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		if _, ok := Tpl.store.load().get("index.html"); ok {
+			t.Fatalf("Expected the template not to be loaded yet.")
+		}
+
+		edge := GraphEdge{From: "index.html", To: "partials/_header.html", Kind: EdgePartial}
+		edges := Tpl.Graph().Edges
+		if len(edges) != 1 || edges[0] != edge {
+			t.Fatalf("Expected the edge %v. Instead got: %v", edge, edges)
+		}
+	})
+}
+
+func TestTemplateCycle(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	_, err := Tpl.AddTemplate("a.html", "", `a{{ block "b" . }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("b.html", "a.html", `{{ define "b" }}b{{ block "c" . }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("c.html", "b.html", `{{ define "c" }}c{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	_, err = Tpl.PutTemplate("a.html", "c.html", `{{ define "b" }}{{ end }}`)
+	cerr, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("Expected a *CycleError. Instead got: %v", err)
+	}
+	if strings.Join(cerr.Chain, " -> ") != "a.html -> c.html -> b.html -> a.html" {
+		t.Fatalf("Expected the full cycle. Instead got: %v", cerr)
+	}
+
+	_, err = Tpl.PutTemplate("a.html", "a.html", `{{ define "b" }}{{ end }}`)
+	if _, ok := err.(*CycleError); !ok {
+		t.Fatalf("Expected a *CycleError. Instead got: %v", err)
+	}
+
+	// the store is unchanged
+	d, err := Tpl.ExecuteTemplate("c.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "abc" {
+		t.Fatalf("Expected \"abc\". Instead got: %q", d)
+	}
+}
+
+func TestRebuildCachedLayers(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// poll rarely enough that the watcher never sees the change below
+	Tpl := NewTplSysWithConfig(dir+"/", Config{Watcher: WatchPoll, PollInterval: time.Hour})
+
+	err = ioutil.WriteFile(filepath.Join(dir, "child.html"), []byte(`{{ define "body" }}child{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("base.html", "", `base:{{ block "body" . }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("child.html", "base.html", "", "child.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	// a base rebuild uses the child's parsed source, not the file on disk
+	err = ioutil.WriteFile(filepath.Join(dir, "child.html"), []byte(`{{ define "body" }}changed{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	_, err = Tpl.PutTemplate("base.html", "", `new base:{{ block "body" . }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+	}
+
+	d, err := Tpl.ExecuteTemplate("child.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "new base:child" {
+		t.Fatalf("Expected \"new base:child\". Instead got: %q", d)
+	}
+
+	// an explicit reload picks up the file
+	err = Tpl.Reload("child.html")
+	if err != nil {
+		t.Fatalf("Expected to reload the template. Instead got the error: %v", err)
+	}
+	d, err = Tpl.ExecuteTemplate("child.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "new base:changed" {
+		t.Fatalf("Expected \"new base:changed\". Instead got: %q", d)
+	}
+}
+
+func TestLazyTemplates(t *testing.T) {
+	Tpl := NewTplSysWithConfig("./", Config{Lazy: true, MaxTemplates: 2})
+
+	loaded := func() int {
+		return Tpl.store.load().tmpls.Len()
+	}
+
+	_, err := Tpl.AddTemplate("base.html", "", `<main>{{ block "content" . }}{{ end }}</main>`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	for _, name := range []string{"a.html", "b.html", "c.html"} {
+		_, err = Tpl.AddTemplate(name, "base.html", fmt.Sprintf(`{{ define "content" }}%s{{ end }}`, name))
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+	_, err = Tpl.AddTemplate("a.html", "", "a")
+	if err != ErrTmplExists {
+		t.Fatalf("Expected ErrTmplExists. Instead got: %v", err)
+	}
+	if loaded() != 0 {
+		t.Fatalf("Expected no template to be parsed yet. Instead got %d loaded", loaded())
+	}
+
+	check := func(name, want string) {
+		d, err := Tpl.ExecuteTemplate(name, nil)
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != want {
+			t.Fatalf("Expected %q. Instead got: %q", want, d)
+		}
+	}
+
+	t.Run("Load", func(t *testing.T) {
+		check("a.html", "<main>a.html</main>")
+		check("b.html", "<main>b.html</main>")
+		check("c.html", "<main>c.html</main>")
+		if loaded() != 2 {
+			t.Fatalf("Expected 2 templates to stay loaded. Instead got %d", loaded())
+		}
+		if _, ok := Tpl.store.load().get("a.html"); ok {
+			t.Fatalf("Expected the least recently used template to be unloaded.")
+		}
+
+		// unloaded templates are parsed again
+		check("a.html", "<main>a.html</main>")
+	})
+
+	t.Run("Base", func(t *testing.T) {
+		_, err := Tpl.PutTemplate("base.html", "", `<div>{{ block "content" . }}{{ end }}</div>`)
+		if err != nil {
+			t.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+		}
+		check("a.html", "<div>a.html</div>")
+		check("b.html", "<div>b.html</div>")
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := Tpl.AddTemplate("broken.html", "", `{{ if }}`)
+		if err != nil {
+			t.Fatalf("Expected to register the template. Instead got the error: %v", err)
+		}
+		_, err = Tpl.ExecuteTemplate("broken.html", nil)
+		if err == nil {
+			t.Fatalf("Expected a parse error.")
+		}
+		info, err := Tpl.Template("broken.html")
+		if err != nil {
+			t.Fatalf("Expected template info. Instead got the error: %v", err)
+		}
+		if info.LastError == nil {
+			t.Fatalf("Expected the parse error to be recorded.")
+		}
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		base := `<main>{{ block "content" . }}{{ end }}</main>`
+		page := `{{ define "content" }}page{{ end }}`
+		// room for the base and one page that counts the base too
+		max := int64(3*len(base) + 3*(len(base)+len(page)))
+		Tpl := NewTplSysWithConfig("./", Config{Lazy: true, MaxTemplateBytes: max})
+
+		_, err := Tpl.AddTemplate("base.html", "", base)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		for _, name := range []string{"a.html", "b.html"} {
+			_, err = Tpl.AddTemplate(name, "base.html", page)
+			if err != nil {
+				t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+			}
+			if _, err = Tpl.ExecuteTemplate(name, nil); err != nil {
+				t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+			}
+		}
+		if n := Tpl.store.load().tmpls.Len(); n != 2 {
+			t.Fatalf("Expected the base and one page to stay loaded. Instead got %d", n)
+		}
+		if _, ok := Tpl.store.load().get("a.html"); ok {
+			t.Fatalf("Expected a.html to be unloaded.")
+		}
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	for _, tmpl := range []struct{ name, base, src string }{
+		{"layout/base.html", "", `<main>{{ block "content" . }}{{ end }}</main>`},
+		{"layout/index.html", "", "layout index"},
+		{"content/index.html", "", "content index"},
+		{"admin/index.html", "", "admin index"},
+		{"partials/about.html", "", "about partial"},
+		{"content/about.html", "base.html", `{{ define "content" }}about {{ partial "about.html" }}{{ end }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, tmpl.base, tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"content/index.html": "content index",
+		"admin/index.html":   "admin index",
+		"content/about.html": "<main>about about partial</main>",
+	} {
+		d, err := Tpl.ExecuteTemplate(name, nil)
+		if err != nil {
+			t.Fatalf("Expected to execute %q. Instead got the error: %v", name, err)
+		}
+		if string(d) != want {
+			t.Fatalf("Expected %q. Instead got: %q", want, d)
+		}
+	}
+
+	_, err := Tpl.ExecuteTemplate("index.html", nil)
+	aerr, ok := err.(*AmbiguousNameError)
+	if !ok {
+		t.Fatalf("Expected an *AmbiguousNameError. Instead got: %v", err)
+	}
+	if strings.Join(aerr.Matches, " ") != "content/index.html layout/index.html" {
+		t.Fatalf("Expected the matching templates. Instead got: %v", aerr.Matches)
+	}
+
+	// the base was resolved and is stored by its key
+	ancestors, err := Tpl.Ancestors("content/about.html")
+	if err != nil {
+		t.Fatalf("Expected the ancestors of content/about.html. Instead got the error: %v", err)
+	}
+	if len(ancestors) != 1 || ancestors[0] != "layout/base.html" {
+		t.Fatalf("Expected [layout/base.html]. Instead got: %v", ancestors)
+	}
+}
+
+func TestPathConfinement(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "page.html"), []byte("page"), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(outside, "secret.html"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+	secret, err := filepath.Abs(filepath.Join(outside, "secret.html"))
+	if err != nil {
+		t.Fatalf("Expected an absolute path. Instead got the error: %v", err)
+	}
+	err = os.Symlink(secret, filepath.Join(dir, "link.html"))
+	if err != nil {
+		t.Fatalf("Expected to make a symlink. Instead got the error: %v", err)
+	}
+
+	Tpl := NewTplSys(dir + "/")
+
+	t.Run("Traversal", func(t *testing.T) {
+		_, err := Tpl.AddTemplate("secret.html", "", "", "../"+filepath.Base(outside)+"/secret.html")
+		if err != ErrPathEscapes {
+			t.Fatalf("Expected ErrPathEscapes. Instead got: %v", err)
+		}
+		err = Tpl.Reload("../" + filepath.Base(outside) + "/secret.html")
+		if err != ErrPathEscapes {
+			t.Fatalf("Expected ErrPathEscapes. Instead got: %v", err)
+		}
+		if p := Tpl.Partial("../../" + filepath.Base(outside) + "/secret.html"); p != "" {
+			t.Fatalf("Expected the partial to be rejected. Instead got: %q", p)
+		}
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		_, err := Tpl.AddTemplate("link.html", "", "", "link.html")
+		if err != ErrPathEscapes {
+			t.Fatalf("Expected ErrPathEscapes. Instead got: %v", err)
+		}
+
+		// symlinks are only followed out of the root if that is allowed
+		_, err = NewTplSysWithConfig(dir+"/", Config{FollowSymlinks: true}).AddTemplate("link.html", "", "", "link.html")
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	})
+
+	t.Run("SymlinkSwap", func(t *testing.T) {
+		err := ioutil.WriteFile(filepath.Join(dir, "swap.html"), []byte("swap"), 0644)
+		if err != nil {
+			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+		}
+		// the poller reloads the file on its own, without Reload's checks
+		Tpl := NewTplSysWithConfig(dir+"/", Config{Watcher: WatchPoll, PollInterval: 10 * time.Millisecond})
+		_, err = Tpl.AddTemplate("swap.html", "", "", "swap.html")
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+
+		// replaced by a symlink after it was added
+		err = os.Symlink(secret, filepath.Join(dir, "swap.tmp"))
+		if err != nil {
+			t.Fatalf("Expected to make a symlink. Instead got the error: %v", err)
+		}
+		err = os.Rename(filepath.Join(dir, "swap.tmp"), filepath.Join(dir, "swap.html"))
+		if err != nil {
+			t.Fatalf("Expected to replace the file. Instead got the error: %v", err)
+		}
+		waitFor(t, func() bool {
+			info, err := Tpl.Template("swap.html")
+			return err == nil && info.LastError == ErrPathEscapes
+		})
+		d, err := Tpl.ExecuteTemplate("swap.html", nil)
+		if err != nil || string(d) != "swap" {
+			t.Fatalf("Expected the old version of the template. Instead got: %q, %v", d, err)
+		}
+	})
+
+	t.Run("Filenames", func(t *testing.T) {
+		filenames := []string{"page.html"}
+		_, err := Tpl.AddTemplate("page.html", "", "", filenames...)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		if filenames[0] != "page.html" {
+			t.Fatalf("Expected the filenames to be left alone. Instead got: %v", filenames)
+		}
+	})
+}
+
+func TestSameBaseName(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"content", "admin"} {
+		err = os.MkdirAll(filepath.Join(dir, d), 0777)
+		if err != nil {
+			t.Fatalf("Expected to make a directory. Instead got the error: %v", err)
+		}
+	}
+	for name, src := range map[string]string{
+		"both.html":          `{{ template "content/index.html" }}|{{ template "admin/index.html" }}`,
+		"index.html":         `<main>{{ block "content" . }}{{ end }}</main>`,
+		"content/index.html": `content{{ define "content" }}child{{ end }}`,
+		"admin/index.html":   "admin",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+		if err != nil {
+			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+		}
+	}
+
+	Tpl := NewTplSys(dir + "/")
+	_, err = Tpl.AddTemplate("both.html", "", "", "both.html", "content/index.html", "admin/index.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("index.html", "", "", "index.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	// its file doesn't replace the root of the base
+	_, err = Tpl.AddTemplate("content/index.html", "index.html", "", "content/index.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"both.html":          "content|admin",
+		"content/index.html": "<main>child</main>",
+	} {
+		d, err := Tpl.ExecuteTemplate(name, nil)
+		if err != nil {
+			t.Fatalf("Expected to execute %q. Instead got the error: %v", name, err)
+		}
+		if string(d) != want {
+			t.Fatalf("Expected %q. Instead got: %q", want, d)
+		}
+	}
+}
+
+func TestPartialLookup(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"nav", "shared"} {
+		err = os.MkdirAll(filepath.Join(dir, "partials", d), 0777)
+		if err != nil {
+			t.Fatalf("Expected to make a partials directory. Instead got the error: %v", err)
+		}
+	}
+	for name, src := range map[string]string{
+		"_header.html":       "header",
+		"nav/main.html":      "nav",
+		"shared/footer.tmpl": "footer",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, "partials", name), []byte(src), 0644)
+		if err != nil {
+			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+		}
+	}
+
+	Tpl := NewTplSysWithConfig(dir+"/", Config{
+		PartialDirs: []string{"", "shared"},
+		PartialExts: []string{".html", ".tmpl"},
+	})
+	_, err = Tpl.AddTemplate("index.html", "", `{{ partial "header" }}|{{ partial "_header" }}|{{ partial "_header.html" }}|{{ partial "nav/main" }}|{{ partial "footer" }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	d, err := Tpl.ExecuteTemplate("index.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "header|header|header|nav|footer" {
+		t.Fatalf("Expected \"header|header|header|nav|footer\". Instead got: %q", d)
+	}
+
+	snap := Tpl.store.load()
+	if key := Tpl.resolvePartial(snap, "", "footer"); key != "partials/shared/footer.tmpl" {
+		t.Fatalf("Expected \"partials/shared/footer.tmpl\". Instead got: %q", key)
+	}
+	if key, ok := Tpl.partials.get(snap.gen, "footer"); !ok || key != "partials/shared/footer.tmpl" {
+		t.Fatalf("Expected the resolution to be cached. Instead got: %q", key)
+	}
+}
+
+func TestThemes(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		// poll so rarely that only Reload can pick up changes
+		testThemes(t, Config{Watcher: WatchPoll, PollInterval: time.Hour})
+	})
+	// fsnotify drops the watch of a deleted override on its own
+	t.Run("fsnotify", func(t *testing.T) {
+		testThemes(t, Config{})
+	})
+}
+
+func testThemes(t *testing.T, cfg Config) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	theme := filepath.Join(dir, "themes", "base")
+
+	for path, src := range map[string]string{
+		filepath.Join(theme, "layout", "_base.html"):  `<theme>{{ block "content" . }}{{ end }}</theme>`,
+		filepath.Join(theme, "partials", "_nav.html"): "theme nav",
+		filepath.Join(dir, "content", "index.html"):   `{{ define "content" }}{{ partial "nav" }}{{ end }}`,
+	} {
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatalf("Expected to make a template directory. Instead got the error: %v", err)
+		}
+		err = ioutil.WriteFile(path, []byte(src), 0644)
+		if err != nil {
+			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+		}
+	}
+
+	cfg.ThemeDirs = []string{theme + "/"}
+	Tpl := NewTplSysWithConfig(dir+"/", cfg)
+	err = Tpl.WatchDir("layout", "")
+	if err != nil {
+		t.Fatalf("Expected to watch the layouts. Instead got the error: %v", err)
+	}
+	err = Tpl.WatchDir("content", "layout/_base.html")
+	if err != nil {
+		t.Fatalf("Expected to watch the content. Instead got the error: %v", err)
+	}
+
+	check := func(want string) {
+		d, err := Tpl.ExecuteTemplate("content/index.html", nil)
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != want {
+			t.Fatalf("Expected %q. Instead got: %q", want, d)
+		}
+	}
+	root := func(name string) string {
+		info, err := Tpl.Template(name)
+		if err != nil {
+			t.Fatalf("Expected template info. Instead got the error: %v", err)
+		}
+		return info.Root
+	}
+
+	check("<theme>theme nav</theme>")
+	if root("layout/_base.html") != theme+"/" {
+		t.Fatalf("Expected the layout to come from the theme. Instead got: %q", root("layout/_base.html"))
+	}
+	if root("content/index.html") != dir+"/" {
+		t.Fatalf("Expected the page to come from the site. Instead got: %q", root("content/index.html"))
+	}
+
+	// site files override the theme
+	for path, src := range map[string]string{
+		"layout/_base.html":  `<site>{{ block "content" . }}{{ end }}</site>`,
+		"partials/_nav.html": "site nav",
+	} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0777)
+		if err != nil {
+			t.Fatalf("Expected to make a template directory. Instead got the error: %v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, path), []byte(src), 0644)
+		if err != nil {
+			t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+		}
+		err = Tpl.Reload(path)
+		if err != nil {
+			t.Fatalf("Expected to reload the template. Instead got the error: %v", err)
+		}
+	}
+	check("<site>site nav</site>")
+	if root("layout/_base.html") != dir+"/" {
+		t.Fatalf("Expected the layout to come from the site. Instead got: %q", root("layout/_base.html"))
+	}
+
+	// and the theme is used again once the override is gone
+	err = os.Remove(filepath.Join(dir, "layout", "_base.html"))
+	if err != nil {
+		t.Fatalf("Expected to remove the override. Instead got the error: %v", err)
+	}
+	err = Tpl.Reload("layout/_base.html")
+	if err != nil {
+		t.Fatalf("Expected to reload the template. Instead got the error: %v", err)
+	}
+	check("<theme>site nav</theme>")
+}
+
+func TestSaveTemplateChildFailure(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "testData-")
+	if err != nil {
+		t.Fatalf("Expected to make a temporary directory. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "child.html"), []byte(`{{ define "content" }}child{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Expected to write test template. Instead got the error: %v", err)
+	}
+
+	Tpl := NewTplSys(dir + "/")
+	for _, tmpl := range []struct{ name, base, src string }{
+		{"top.html", "", `<top>{{ block "content" . }}{{ end }}</top>`},
+		{"mid.html", "top.html", `{{ define "content" }}mid{{ end }}`},
+		{"sibling.html", "mid.html", `{{ define "content" }}sibling{{ end }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, tmpl.base, tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+	_, err = Tpl.AddTemplate("child.html", "mid.html", "", "child.html")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	// moving mid to another root parses child again, which fails without its file
+	err = os.Remove(filepath.Join(dir, "child.html"))
+	if err != nil {
+		t.Fatalf("Expected to remove the child's file. Instead got the error: %v", err)
+	}
+	_, err = Tpl.PutTemplate("mid.html", "", `<mid>{{ block "content" . }}{{ end }}</mid>`)
+	if err == nil {
+		t.Fatalf("Expected the rebuild of child.html to fail. Instead got nil")
+	}
+
+	// mid and its other child are saved, the failed child keeps its old version
+	for name, want := range map[string]string{
+		"mid.html":     "<mid></mid>",
+		"sibling.html": "<mid>sibling</mid>",
+		"child.html":   "<top>child</top>",
+	} {
+		d, err := Tpl.ExecuteTemplate(name, nil)
+		if err != nil || string(d) != want {
+			t.Fatalf("Expected %q to render %q. Instead got: %q, %v", name, want, d, err)
+		}
+	}
+	ancestors, err := Tpl.Ancestors("mid.html")
+	if err != nil || len(ancestors) != 0 {
+		t.Fatalf("Expected mid.html to be a root template. Instead got: %v, %v", ancestors, err)
+	}
+	info, err := Tpl.Template("child.html")
+	if err != nil || info.LastError == nil {
+		t.Fatalf("Expected the failed rebuild to be recorded. Instead got: %+v, %v", info, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	for _, tmpl := range []struct{ name, base, src string }{
+		{"layout/base.html", "", `<main>{{ block "content" . }}{{ end }}</main>`},
+		{"partials/_nav.html", "", "shared nav"},
+		{"content/index.html", "base.html", `{{ define "content" }}{{ partial "nav" }}{{ end }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, tmpl.base, tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	a := Tpl.Overlay("a")
+	b := Tpl.Overlay("b")
+	_, err := a.PutTemplate("partials/_nav.html", "", "a nav")
+	if err != nil {
+		t.Fatalf("Expected to put template in overlay. Instead got the error: %v", err)
+	}
+	_, err = a.AddTemplate("content/about.html", "base.html", `{{ define "content" }}a about{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to overlay. Instead got the error: %v", err)
+	}
+
+	check := func(execute func(string, interface{}) ([]byte, error), name, want string) {
+		d, err := execute(name, nil)
+		if err != nil {
+			t.Fatalf("Expected to execute %q. Instead got the error: %v", name, err)
+		}
+		if string(d) != want {
+			t.Fatalf("Expected %q. Instead got: %q", want, d)
+		}
+	}
+
+	// renders of different tenants are interleaved on purpose
+	for i := 0; i < 2; i++ {
+		check(a.ExecuteTemplate, "index.html", "<main>a nav</main>")
+		check(b.ExecuteTemplate, "index.html", "<main>shared nav</main>")
+		check(Tpl.ExecuteTemplate, "index.html", "<main>shared nav</main>")
+	}
+	// renderers are reused across tenants instead of being made per render
+	single := testing.AllocsPerRun(20, func() {
+		Tpl.ExecuteTemplate("index.html", nil)
+	})
+	mixed := testing.AllocsPerRun(20, func() {
+		a.ExecuteTemplate("index.html", nil)
+		b.ExecuteTemplate("index.html", nil)
+		Tpl.ExecuteTemplate("index.html", nil)
+	})
+	if mixed > 6*single {
+		t.Fatalf("Expected interleaved tenants to reuse renderers. Instead got %.0f allocs against %.0f for one tenant", mixed, single)
+	}
+
+	check(a.ExecuteTemplate, "about.html", "<main>a about</main>")
+	_, err = b.ExecuteTemplate("about.html", nil)
+	if err != ErrTmplNotFound {
+		t.Fatalf("Expected ErrTmplNotFound. Instead got: %v", err)
+	}
+
+	// shared base changes reach the overlays
+	_, err = Tpl.PutTemplate("layout/base.html", "", `<div>{{ block "content" . }}{{ end }}</div>`)
+	if err != nil {
+		t.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+	}
+	check(a.ExecuteTemplate, "about.html", "<div>a about</div>")
+	check(a.ExecuteTemplate, "index.html", "<div>a nav</div>")
+
+	err = a.RemoveTemplate("partials/_nav.html", RemoveRestrict)
+	if err != nil {
+		t.Fatalf("Expected to remove the template. Instead got the error: %v", err)
+	}
+	check(a.ExecuteTemplate, "index.html", "<div>shared nav</div>")
+
+	// the tenant's own templates pick up a partial it overrides later
+	_, err = a.PutTemplate("content/about.html", "base.html", `{{ define "content" }}a {{ partial "nav" }}{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to put template in overlay. Instead got the error: %v", err)
+	}
+	check(a.ExecuteTemplate, "about.html", "<div>a shared nav</div>")
+	_, err = a.PutTemplate("partials/_nav.html", "", "a nav")
+	if err != nil {
+		t.Fatalf("Expected to put template in overlay. Instead got the error: %v", err)
+	}
+	check(a.ExecuteTemplate, "about.html", "<div>a a nav</div>")
+}
+
+func TestPartialArgs(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	for _, tmpl := range []struct{ name, src string }{
+		{"partials/_card.html", `<a href="{{ .url }}">{{ .title }}</a> on {{ (root).Site }}`},
+		{"partials/_sum.html", `ignored{{ return (add .a .b) }}`},
+		{"partials/_pair.html", `{{ return (dict "first" .a "second" .b) }}`},
+		{"index.html", `{{ partial "card" "title" .Title "url" .URL }}|{{ partialValue "sum" "a" 1 "b" 2 }}|{{ with partialValue "pair" "a" "x" "b" "y" }}{{ .second }}{{ .first }}{{ end }}|{{ partial "sum" "a" 1 "b" 2 }}`},
+		{"bad.html", `{{ partialValue "sum" "a" 1 "b" }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	ctx := map[string]interface{}{"Title": "Home", "URL": "/", "Site": "example.com"}
+	d, err := Tpl.ExecuteTemplate("index.html", ctx)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != `<a href="/">Home</a> on example.com|3|yx|ignored` {
+		t.Fatalf("Expected named arguments and return values. Instead got: %q", d)
+	}
+
+	_, err = Tpl.ExecuteTemplate("bad.html", nil)
+	if err == nil || !strings.Contains(err.Error(), ErrPartialArgs.Error()) {
+		t.Fatalf("Expected an error about the partial arguments. Instead got: %v", err)
+	}
+}
+
+func TestPartialParams(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	card := `{{/*
+	@param title string required
+	@param url string default "/home"
+	@param count int default 3
+	@param tags slice
+*/}}<a href="{{ .url }}">{{ .title }}</a> {{ .count }}{{ range .tags }} {{ . }}{{ end }}{{ return .count }}`
+	for _, tmpl := range []struct{ name, src string }{
+		{"partials/_card.html", card},
+		{"index.html", `{{ partial "card" "title" "Home" }}|{{ partial "card" "title" "Docs" "url" "/docs" "count" 1 "tags" .Tags }}`},
+		{"missing.html", `{{ partialValue "card" "url" "/" }}`},
+		{"mistyped.html", `{{ partialValue "card" "title" "Home" "count" "three" }}`},
+		{"unknown.html", `{{ partialValue "card" "title" "Home" "colour" "red" }}`},
+		{"context.html", `{{ partialValue "card" . }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	d, err := Tpl.ExecuteTemplate("index.html", map[string]interface{}{"Tags": []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != `<a href="/home">Home</a> 3|<a href="/docs">Docs</a> 1 a b` {
+		t.Fatalf("Expected the defaults to be applied. Instead got: %q", d)
+	}
+
+	for _, tc := range []struct{ name, param, reason string }{
+		{"missing.html", "title", "is required"},
+		{"mistyped.html", "count", "must be int, got string"},
+		{"unknown.html", "colour", "is not declared"},
+		{"context.html", "", "must be called with named arguments"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Tpl.ExecuteTemplate(tc.name, "ctx")
+			if err == nil {
+				t.Fatalf("Expected an error about parameter %q. Instead got nil", tc.param)
+			}
+			for _, s := range []string{`partial "partials/_card.html"`, `called from "` + tc.name + `"`, `parameter "` + tc.param + `"`, tc.reason} {
+				if tc.param == "" && strings.HasPrefix(s, "parameter") {
+					continue
+				}
+				if !strings.Contains(err.Error(), s) {
+					t.Fatalf("Expected the error to contain %q. Instead got: %v", s, err)
+				}
+			}
+		})
+	}
+
+	t.Run("bad header", func(t *testing.T) {
+		_, err := Tpl.AddTemplate("partials/_bad.html", "", `{{/* @param count int default three */}}`)
+		if err == nil {
+			t.Fatalf("Expected an error about the default value. Instead got nil")
+		}
+	})
+}
+
+func TestStrictPartials(t *testing.T) {
+	newTpl := func(cfg Config) *TplSys {
+		Tpl := NewTplSysWithConfig("./", cfg)
+		for _, tmpl := range []struct{ name, src string }{
+			{"partials/_broken.html", `{{ .Items.Missing }}`},
+			{"partials/_outer.html", `outer[{{ partial "broken" . }}]`},
+			{"index.html", `{{ partial "outer" . }}`},
+		} {
+			_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+			if err != nil {
+				t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+			}
+		}
+		return Tpl
+	}
+	ctx := map[string]interface{}{"Items": []int{1}}
+
+	t.Run("strict", func(t *testing.T) {
+		Tpl := newTpl(Config{StrictPartials: true})
+		_, err := Tpl.ExecuteTemplate("index.html", ctx)
+		perr, ok := err.(*PartialError)
+		if !ok {
+			t.Fatalf("Expected a *PartialError. Instead got: %v", err)
+		}
+		stack := []string{"index.html", "partials/_outer.html", "partials/_broken.html"}
+		if perr.Partial != "partials/_broken.html" || !reflect.DeepEqual(perr.Stack, stack) {
+			t.Fatalf("Expected the error of %q with the stack %v. Instead got: %v", stack[2], stack, err)
+		}
+		if n := Tpl.PartialErrors()["partials/_broken.html"]; n != 1 {
+			t.Fatalf("Expected 1 error to be counted. Instead got: %d", n)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		Tpl := newTpl(Config{PartialPlaceholder: "<!-- partial failed -->"})
+		d, err := Tpl.ExecuteTemplate("index.html", ctx)
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != "outer[<!-- partial failed -->]" {
+			t.Fatalf("Expected the placeholder in place of the partial. Instead got: %q", d)
+		}
+		if n := Tpl.PartialErrors()["partials/_broken.html"]; n != 1 {
+			t.Fatalf("Expected 1 error to be counted. Instead got: %d", n)
+		}
+	})
+}
+
+func TestMaxPartialDepth(t *testing.T) {
+	Tpl := NewTplSysWithConfig("./", Config{StrictPartials: true, MaxPartialDepth: 3})
+
+	for _, tmpl := range []struct{ name, src string }{
+		// the data bug: every item is its own child
+		{"partials/_menu.html", `<li>{{ .Name }}{{ range .Children }}{{ partial "menu" . }}{{ end }}</li>`},
+		{"index.html", `<ul>{{ partial "menu" . }}</ul>`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	item := map[string]interface{}{"Name": "a"}
+	d, err := Tpl.ExecuteTemplate("index.html", item)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "<ul><li>a</li></ul>" {
+		t.Fatalf("Expected the menu. Instead got: %q", d)
+	}
+
+	item["Children"] = []interface{}{item}
+	_, err = Tpl.ExecuteTemplate("index.html", item)
+	perr, ok := err.(*PartialError)
+	if !ok || perr.Err != ErrPartialDepth {
+		t.Fatalf("Expected ErrPartialDepth. Instead got: %v", err)
+	}
+	stack := []string{"index.html", "partials/_menu.html", "partials/_menu.html", "partials/_menu.html", "partials/_menu.html"}
+	if !reflect.DeepEqual(perr.Stack, stack) {
+		t.Fatalf("Expected the recursion chain %v. Instead got: %v", stack, perr.Stack)
+	}
+
+	// every call fans out, so carrying on past the limit would never finish
+	t.Run("lenient", func(t *testing.T) {
+		Tpl := NewTplSys("./")
+		for _, tmpl := range []struct{ name, src string }{
+			{"partials/_tree.html", `<li>{{ partial "tree" . }}{{ partial "tree" . }}</li>`},
+			{"index.html", `<ul>{{ partial "tree" . }}</ul>`},
+		} {
+			_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+			if err != nil {
+				t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+			}
+		}
+
+		_, err := Tpl.ExecuteTemplate("index.html", nil)
+		perr, ok := err.(*PartialError)
+		if !ok || perr.Err != ErrPartialDepth {
+			t.Fatalf("Expected ErrPartialDepth. Instead got: %v", err)
+		}
+		if len(perr.Stack) != DefaultMaxPartialDepth+2 {
+			t.Fatalf("Expected a chain of %d templates. Instead got: %d", DefaultMaxPartialDepth+2, len(perr.Stack))
+		}
+	})
+}
+
+// countingCtx counts how many times it is rendered
+type countingCtx struct {
+	n *int
+}
+
+func (c countingCtx) Count() int {
+	*c.n++
+	return *c.n
+}
+
+func TestPartialCached(t *testing.T) {
+	Tpl := NewTplSysWithConfig("./", Config{PartialCacheTTL: time.Hour})
+
+	for _, tmpl := range []struct{ name, base, src string }{
+		{"layout/_frame.html", "", `[{{ block "body" . }}{{ end }}]`},
+		{"partials/_logo.html", "", `logo`},
+		{"partials/_header.html", "layout/_frame.html", `{{ define "body" }}{{ .Count }} {{ partial "logo" }}{{ end }}`},
+		{"index.html", "", `{{ partialCached "header" . "en" }}|{{ partialCached "header" . "fr" }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, tmpl.base, tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	var n int
+	render := func(expected string) {
+		d, err := Tpl.ExecuteTemplate("index.html", countingCtx{&n})
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != expected {
+			t.Fatalf("Expected %q. Instead got: %q", expected, d)
+		}
+	}
+
+	// one render per variant
+	render("[1 logo]|[2 logo]")
+	render("[1 logo]|[2 logo]")
+
+	for _, tc := range []struct{ name, base, src, expected string }{
+		{"partials/_header.html", "layout/_frame.html", `{{ define "body" }}{{ .Count }} {{ partial "logo" }}!{{ end }}`, "[3 logo!]|[4 logo!]"},
+		{"layout/_frame.html", "", `({{ block "body" . }}{{ end }})`, "(5 logo!)|(6 logo!)"},
+		{"partials/_logo.html", "", `LOGO`, "(7 LOGO!)|(8 LOGO!)"},
+	} {
+		_, err := Tpl.PutTemplate(tc.name, tc.base, tc.src)
+		if err != nil {
+			t.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+		}
+		render(tc.expected)
+		render(tc.expected)
+	}
+
+	snap := Tpl.store.load()
+	t.Run("ttl", func(t *testing.T) {
+		c := newOutputCache(2, 0, time.Millisecond)
+		c.put("a", []byte("aaaa"), nil)
+		if _, _, ok := c.get("a", snap); !ok {
+			t.Fatalf("Expected the output to be cached. Instead got nothing")
+		}
+		time.Sleep(5 * time.Millisecond)
+		if _, _, ok := c.get("a", snap); ok {
+			t.Fatalf("Expected the output to expire. Instead it is still cached")
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		c := newOutputCache(2, 10, 0)
+		c.put("a", []byte("aaaa"), nil)
+		c.put("b", []byte("bbbb"), nil)
+		c.put("c", []byte("cccc"), nil)
+		c.put("d", []byte("this is too big"), nil)
+		for key, cached := range map[string]bool{"a": false, "b": true, "c": true, "d": false} {
+			if _, _, ok := c.get(key, snap); ok != cached {
+				t.Fatalf("Expected %q to be cached: %v. Instead got: %v", key, cached, ok)
+			}
+		}
+	})
+}
+
+func TestExecuteTemplateCached(t *testing.T) {
+	Tpl := NewTplSysWithConfig("./", Config{PageCacheSize: 10})
+
+	for _, tmpl := range []struct{ name, base, src string }{
+		{"layout/_base.html", "", `<main>{{ block "content" . }}{{ end }}</main>`},
+		{"partials/_footer.html", "", `footer`},
+		{"content/about.html", "layout/_base.html", `{{ define "content" }}{{ .Count }} {{ partial "footer" }}{{ end }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, tmpl.base, tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	var n int
+	render := func(t *testing.T, key, expected string) {
+		d, err := Tpl.ExecuteTemplateCached("about.html", key, countingCtx{&n})
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != expected {
+			t.Fatalf("Expected %q. Instead got: %q", expected, d)
+		}
+		// the page is a copy
+		d[0] = 'x'
+	}
+
+	render(t, "/about", "<main>1 footer</main>")
+	render(t, "/about", "<main>1 footer</main>")
+	render(t, "/about?page=2", "<main>2 footer</main>")
+
+	for _, tc := range []struct{ name, base, src, expected string }{
+		{"layout/_base.html", "", `<div>{{ block "content" . }}{{ end }}</div>`, "<div>3 footer</div>"},
+		{"partials/_footer.html", "", `FOOTER`, "<div>4 FOOTER</div>"},
+		{"content/about.html", "layout/_base.html", `{{ define "content" }}{{ .Count }}{{ end }}`, "<div>5</div>"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Tpl.PutTemplate(tc.name, tc.base, tc.src)
+			if err != nil {
+				t.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+			}
+			render(t, "/about", tc.expected)
+			render(t, "/about", tc.expected)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		Tpl := NewTplSys("./")
+		_, err := Tpl.AddTemplate("index.html", "", `{{ .Count }}`)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		for _, expected := range []string{"6", "7"} {
+			d, err := Tpl.ExecuteTemplateCached("index.html", "/", countingCtx{&n})
+			if err != nil || string(d) != expected {
+				t.Fatalf("Expected %q. Instead got: %q, %v", expected, d, err)
+			}
+		}
+	})
+}
+
+func TestComponents(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	for _, tmpl := range []struct{ name, src string }{
+		{"partials/_card.html", `<div class="card"><h2>{{ .title }}</h2>{{ slot }}{{ if hasSlot "footer" }}<footer>{{ slot "footer" }}</footer>{{ end }}</div>`},
+		{"partials/_modal.html", `<dialog>{{ with component "card" "title" .title }}{{ slot }}{{ end }}</dialog>`},
+		{"index.html", `{{ with component "card" "title" .Title }}<p>{{ .Summary }}</p>{{ with slot "footer" }}<a href="{{ .URL }}">More</a>{{ end }}{{ end }}|` +
+			`{{ range .Items }}{{ with component "card" "title" . }}<b>{{ . }}</b>{{ end }}{{ end }}|` +
+			`{{ with component "modal" "title" "Modal" }}{{ $.Title }}{{ end }}|` +
+			`{{ range .Items }}{{ with component "card" "title" . }}{{ with $.Summary }}{{ $.Title }}{{ end }}{{ . }}{{ end }}{{ end }}|` +
+			`{{ range .Blank }}{{ with component "card" "title" "blank" }}[{{ . }}]{{ end }}{{ end }}`},
+	} {
+		_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+		if err != nil {
+			t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+	}
+
+	ctx := map[string]interface{}{"Title": "Home", "Summary": "<script>", "URL": "javascript:alert(1)", "Items": []string{"a", "b"}, "Blank": []string{""}}
+	d, err := Tpl.ExecuteTemplate("index.html", ctx)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	expected := `<div class="card"><h2>Home</h2><p>&lt;script&gt;</p><footer><a href="#ZgotmplZ">More</a></footer></div>|` +
+		`<div class="card"><h2>a</h2><b>a</b></div><div class="card"><h2>b</h2><b>b</b></div>|` +
+		`<dialog><div class="card"><h2>Modal</h2>Home</div></dialog>|` +
+		`<div class="card"><h2>a</h2>Homea</div><div class="card"><h2>b</h2>Homeb</div>|` +
+		`<div class="card"><h2>blank</h2>[]</div>`
+	if string(d) != expected {
+		t.Fatalf("Expected %q. Instead got: %q", expected, d)
+	}
+
+	edges := make(map[GraphEdge]bool)
+	for _, e := range Tpl.Graph().Edges {
+		edges[e] = true
+	}
+	for _, p := range []string{"partials/_card.html", "partials/_modal.html"} {
+		if e := (GraphEdge{From: "index.html", To: p, Kind: EdgePartial}); !edges[e] {
+			t.Fatalf("Expected the graph to have the edge %v. Instead got: %v", e, edges)
+		}
+	}
+
+	t.Run("variables", func(t *testing.T) {
+		_, err := Tpl.AddTemplate("vars.html", "", `{{ $x := 1 }}{{ with component "card" "title" "t" }}{{ $x }}{{ end }}`)
+		if err == nil || !strings.Contains(err.Error(), "$x") {
+			t.Fatalf("Expected an error about $x. Instead got: %v", err)
+		}
+	})
+}
+
+// reloadingCtx puts a new version of a partial while the template using it
+// is being executed
+type reloadingCtx struct {
+	Tpl *TplSys
+}
+
+func (c reloadingCtx) Reload() (string, error) {
+	_, err := c.Tpl.PutTemplate("partials/_partial.html", "", "new partial")
+	return "", err
+}
+
+func TestExecuteTemplateSnapshot(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	_, err := Tpl.AddTemplate("partials/_partial.html", "", "old partial")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("index.html", "", `{{ .Reload }}{{ partial "_partial.html" . }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	// the render started before the reload so it keeps using the old partial
+	gen := Tpl.Generation()
+	d, err := Tpl.ExecuteTemplate("index.html", reloadingCtx{Tpl})
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "old partial" {
+		t.Fatalf("Expected \"old partial\". Instead got: %q", d)
+	}
+	if Tpl.Generation() != gen+1 {
+		t.Fatalf("Expected the reload to publish generation %d. Instead got: %d", gen+1, Tpl.Generation())
+	}
+
+	d, err = Tpl.ExecuteTemplate("_partial.html", nil)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "new partial" {
+		t.Fatalf("Expected \"new partial\". Instead got: %q", d)
+	}
+}
+
+type treeNode struct {
+	Name     string
+	Children []treeNode
+}
+
+func TestLinkedPartials(t *testing.T) {
+	Tpl := NewTplSys("./")
+
+	_, err := Tpl.AddTemplate("partials/_greet.html", "", `<b>{{ . }}</b>`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("partials/_tree.html", "", `{{ .Name }}{{ range .Children }}[{{ partial "_tree.html" . }}]{{ end }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("index.html", "", `{{ partial "_greet.html" .Name }}{{ $p := "_greet.html" }}{{ partial $p .Name }}{{ partial "_tree.html" .Tree }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	// partials are linked when the template is stored, before it renders
+	linked := func(name, partial string) bool {
+		e, _ := Tpl.store.load().get(name)
+		p, _ := Tpl.store.load().get(partial)
+		return p != nil && e.linked.deps[partial] == p
+	}
+	if !linked("index.html", "partials/_greet.html") {
+		t.Fatalf("Expected _greet.html to be linked into index.html.")
+	}
+
+	ctx := map[string]interface{}{
+		"Name": "<you>",
+		"Tree": treeNode{Name: "a", Children: []treeNode{{Name: "b", Children: []treeNode{{Name: "c"}}}, {Name: "d"}}},
+	}
+	d, err := Tpl.ExecuteTemplate("index.html", ctx)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if string(d) != "<b>&lt;you&gt;</b><b>&lt;you&gt;</b>a[b[c]][d]" {
+		t.Fatalf("Expected linked and dynamic partials to render the same. Instead got: %q", d)
+	}
+
+	// a changed partial is linked again
+	_, err = Tpl.PutTemplate("partials/_greet.html", "", `<i>{{ . }}</i>`)
+	if err != nil {
+		t.Fatalf("Expected to put template to store. Instead got the error: %v", err)
+	}
+	if !linked("index.html", "partials/_greet.html") {
+		t.Fatalf("Expected the new _greet.html to be linked into index.html.")
+	}
+	d, err = Tpl.ExecuteTemplate("index.html", ctx)
+	if err != nil {
+		t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+	}
+	if !strings.HasPrefix(string(d), "<i>&lt;you&gt;</i><i>&lt;you&gt;</i>") {
+		t.Fatalf("Expected the new partial. Instead got: %q", d)
+	}
+
+	// a partial added after the template calling it is linked into it
+	_, err = Tpl.AddTemplate("late.html", "", `{{ partial "_late.html" }}`)
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("partials/_late.html", "", "late")
+	if err != nil {
+		t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	if !linked("late.html", "partials/_late.html") {
+		t.Fatalf("Expected _late.html to be linked into late.html.")
+	}
+
+	// a failing linked partial is handled where it is called, the page
+	// around it isn't executed again
+	t.Run("failure", func(t *testing.T) {
+		Tpl := NewTplSysWithConfig("./", Config{PartialPlaceholder: "<!-- partial failed -->"})
+		for _, tmpl := range []struct{ name, src string }{
+			{"partials/_broken.html", `{{ .Missing }}`},
+			{"index.html", `{{ .Count }}{{ partial "_broken.html" . }}{{ .Count }}`},
+		} {
+			_, err := Tpl.AddTemplate(tmpl.name, "", tmpl.src)
+			if err != nil {
+				t.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+			}
+		}
+
+		var n int
+		d, err := Tpl.ExecuteTemplate("index.html", countingCtx{&n})
+		if err != nil {
+			t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+		if string(d) != "1<!-- partial failed -->2" || n != 2 {
+			t.Fatalf("Expected the page to run once with the placeholder. Instead got: %q after %d counts", d, n)
+		}
+		if c := Tpl.PartialErrors()["partials/_broken.html"]; c != 1 {
+			t.Fatalf("Expected 1 error to be counted. Instead got: %d", c)
+		}
+	})
+}
+
+// newDeepLayoutTplSys returns a TplSys with a chain of depth layouts, each
+// based on the previous one, and a page based on the last layout
+func newDeepLayoutTplSys(b *testing.B, depth int) *TplSys {
+	Tpl := NewTplSys("./")
+
+	_, err := Tpl.AddTemplate("layout-0.html", "", baseHTML)
+	if err != nil {
+		b.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("partials/_header.html", "", headerHTML)
+	if err != nil {
+		b.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	_, err = Tpl.AddTemplate("partials/_footer.html", "", footerHTML)
+	if err != nil {
+		b.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+
+	base := "layout-0.html"
+	for i := 1; i < depth; i++ {
+		name := fmt.Sprintf("layout-%d.html", i)
+		src := fmt.Sprintf(`{{ define "content" }}<div class="level-%d">{{ block "level-%d" . }}{{ end }}</div>{{ end }}`, i, i)
+		if i > 1 {
+			src = fmt.Sprintf(`{{ define "level-%d" }}<div class="level-%d">{{ block "level-%d" . }}{{ end }}</div>{{ end }}`, i-1, i, i)
+		}
+		_, err = Tpl.AddTemplate(name, base, src)
+		if err != nil {
+			b.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		base = name
+	}
+
+	_, err = Tpl.AddTemplate("page.html", base, fmt.Sprintf(`{{ define "level-%d" }}{{ .Config.Title }}{{ end }}`, depth-1))
+	if err != nil {
+		b.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	return Tpl
+}
+
+func BenchmarkExecuteTemplate(b *testing.B) {
+	Tpl := newDeepLayoutTplSys(b, 8)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Tpl.ExecuteTemplate("page.html", tTmplData)
+		if err != nil {
+			b.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+		}
+	}
+}
+
+func BenchmarkExecuteTemplateParallel(b *testing.B) {
+	Tpl := newDeepLayoutTplSys(b, 8)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := Tpl.ExecuteTemplate("page.html", tTmplData)
+			if err != nil {
+				b.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+			}
+		}
+	})
+}
+
+// newWideLayoutTplSys adds a layout with "sections" children that each have
+// "pages" children of their own
+func newWideLayoutTplSys(tb testing.TB, cfg Config, sections, pages int) *TplSys {
+	Tpl := NewTplSysWithConfig("./", cfg)
+
+	_, err := Tpl.AddTemplate("layout.html", "", `<main>{{ block "section" . }}{{ end }}</main>`)
+	if err != nil {
+		tb.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+	}
+	for i := 0; i < sections; i++ {
+		section := fmt.Sprintf("section-%d.html", i)
+		_, err = Tpl.AddTemplate(section, "layout.html", fmt.Sprintf(`{{ define "section" }}%d:{{ block "page" . }}{{ end }}{{ end }}`, i))
+		if err != nil {
+			tb.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+		}
+		for j := 0; j < pages; j++ {
+			_, err = Tpl.AddTemplate(fmt.Sprintf("page-%d-%d.html", i, j), section, fmt.Sprintf(`{{ define "page" }}%d{{ end }}`, j))
+			if err != nil {
+				tb.Fatalf("Expected to add template to store. Instead got the error: %v", err)
+			}
+		}
+	}
+	return Tpl
+}
+
+func TestRebuildChildTemplates(t *testing.T) {
+	Tpl := newWideLayoutTplSys(t, Config{RebuildWorkers: 4}, 5, 5)
+
+	gen := Tpl.Generation()
+	_, err := Tpl.PutTemplate("layout.html", "", `<div>{{ block "section" . }}{{ end }}</div>`)
+	if err != nil {
+		t.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+	}
+	if Tpl.Generation() != gen+1 {
+		t.Fatalf("Expected the rebuild to be published once. Instead got generation %d, was %d", Tpl.Generation(), gen)
+	}
+
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			d, err := Tpl.ExecuteTemplate(fmt.Sprintf("page-%d-%d.html", i, j), nil)
+			if err != nil {
+				t.Fatalf("Expected to execute the template. Instead got the error: %v", err)
+			}
+			if string(d) != fmt.Sprintf("<div>%d:%d</div>", i, j) {
+				t.Fatalf("Expected \"<div>%d:%d</div>\". Instead got: %q", i, j, d)
+			}
+		}
+	}
+}
+
+func BenchmarkRebuildChildTemplates(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			Tpl := newWideLayoutTplSys(b, Config{RebuildWorkers: workers}, 20, 50)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := Tpl.PutTemplate("layout.html", "", fmt.Sprintf(`<main class="v%d">{{ block "section" . }}{{ end }}</main>`, i))
+				if err != nil {
+					b.Fatalf("Expected to put template in store. Instead got the error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it is true or fails the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the watcher to apply the change. Timed out waiting.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // Test Data
 var baseHTML = `
 <!DOCTYPE html>
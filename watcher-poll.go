@@ -0,0 +1,247 @@
+// Copyright 2016 Bryan Jeal <bryan@jeal.ca>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tmpl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultPollInterval is used by the polling watcher when Config.PollInterval isn't set
+const DefaultPollInterval = time.Second
+
+var errNotWatched = errors.New("can't remove non-existent watch")
+
+// pollState is what the polling watcher remembers about a path
+type pollState struct {
+	modTime time.Time
+	size    int64
+	sum     []byte
+	isDir   bool
+	entries map[string]bool
+}
+
+// pollWatcher detects changes by periodically stat'ing the watched paths.
+// It is used on filesystems that don't deliver inotify (or similar) events
+// such as NFS, FUSE and some Docker bind mounts. Like fsnotify, watching a
+// directory reports files created in or removed from it.
+type pollWatcher struct {
+	interval time.Duration
+	hash     bool
+
+	mu    sync.Mutex
+	paths map[string]*pollState
+
+	events    chan fsnotify.Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollWatcher(interval time.Duration, hash bool) *pollWatcher {
+	return newPollWatcherChans(interval, hash, make(chan fsnotify.Event), make(chan error))
+}
+
+// newPollWatcherChans creates a polling watcher that reports to the given channels
+func newPollWatcherChans(interval time.Duration, hash bool, events chan fsnotify.Event, errs chan error) *pollWatcher {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	w := &pollWatcher{
+		interval: interval,
+		hash:     hash,
+		paths:    make(map[string]*pollState),
+		events:   events,
+		errors:   errs,
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) Add(name string) error {
+	st, err := w.stat(name)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.paths[name] = st
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Remove(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.paths[name]; !ok {
+		return errNotWatched
+	}
+	delete(w.paths, name)
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event { return w.events }
+
+func (w *pollWatcher) Errors() <-chan error { return w.errors }
+
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.poll()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// poll compares every watched path with its last known state. Files are
+// stat'ed without holding the lock and events are sent after it is released
+// so the event handler can call Add/Remove while we wait on it
+func (w *pollWatcher) poll() {
+	w.mu.Lock()
+	old := make(map[string]*pollState, len(w.paths))
+	for name, st := range w.paths {
+		old[name] = st
+	}
+	w.mu.Unlock()
+
+	var evs []fsnotify.Event
+	for name, prev := range old {
+		cur, err := w.stat(name)
+		if os.IsNotExist(err) {
+			evs = append(evs, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+			w.mu.Lock()
+			delete(w.paths, name)
+			w.mu.Unlock()
+			continue
+		} else if err != nil {
+			w.send(fsnotify.Event{}, err)
+			continue
+		}
+
+		if cur.isDir {
+			for e := range cur.entries {
+				if !prev.entries[e] {
+					evs = append(evs, fsnotify.Event{Name: filepath.Join(name, e), Op: fsnotify.Create})
+				}
+			}
+			for e := range prev.entries {
+				if !cur.entries[e] {
+					evs = append(evs, fsnotify.Event{Name: filepath.Join(name, e), Op: fsnotify.Remove})
+				}
+			}
+		} else if !cur.modTime.Equal(prev.modTime) || cur.size != prev.size || !bytes.Equal(cur.sum, prev.sum) {
+			evs = append(evs, fsnotify.Event{Name: name, Op: fsnotify.Write})
+		}
+
+		w.mu.Lock()
+		// don't resurrect a path that was removed in the meantime
+		if _, ok := w.paths[name]; ok {
+			w.paths[name] = cur
+		}
+		w.mu.Unlock()
+	}
+
+	for _, ev := range evs {
+		if !w.send(ev, nil) {
+			return
+		}
+	}
+}
+
+// send delivers an event or error. It returns false if the watcher was closed
+func (w *pollWatcher) send(ev fsnotify.Event, err error) bool {
+	if err != nil {
+		select {
+		case w.errors <- err:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *pollWatcher) stat(name string) (*pollState, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	st := &pollState{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		isDir:   info.IsDir(),
+	}
+
+	if st.isDir {
+		names, err := readDirNames(name)
+		if err != nil {
+			return nil, err
+		}
+		st.entries = make(map[string]bool, len(names))
+		for _, n := range names {
+			st.entries[n] = true
+		}
+		return st, nil
+	}
+
+	if w.hash {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		st.sum = h.Sum(nil)
+	}
+	return st, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
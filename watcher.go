@@ -17,6 +17,11 @@ package tmpl
 import (
 	"html/template"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/hashicorp/go-memdb"
@@ -30,6 +35,8 @@ type tmplData struct {
 	Filenames   []string
 	HasSrc      bool
 	HasBaseTmpl bool
+	LoadedAt    time.Time
+	LastErr     error
 }
 
 type tmplFilename struct {
@@ -38,6 +45,13 @@ type tmplFilename struct {
 	Filename string
 }
 
+// tmplDir is a watched directory. Files created in it are registered with
+// BaseTmplID as their base template
+type tmplDir struct {
+	Dir        string
+	BaseTmplID string
+}
+
 // Template Data DB schema
 var schema = &memdb.DBSchema{
 	Tables: map[string]*memdb.TableSchema{
@@ -74,6 +88,16 @@ var schema = &memdb.DBSchema{
 				},
 			},
 		},
+		"tmplDir": {
+			Name: "tmplDir",
+			Indexes: map[string]*memdb.IndexSchema{
+				"id": {
+					Name:    "id",
+					Unique:  true,
+					Indexer: &memdb.StringFieldIndex{Field: "Dir"},
+				},
+			},
+		},
 	},
 }
 
@@ -92,29 +116,163 @@ func fsnotifyMust(w *fsnotify.Watcher, err error) *fsnotify.Watcher {
 	return w
 }
 
-func (t *TplSys) saveTemplateDataToDB(td *tmplData) error {
-	// Read from TmplDB and remove all old filepaths from watcher
-	tx := t.store.tmplDB.Txn(false)
-	result, err := tx.Get("tmplFilename", "name", td.Name)
+// WatchMode selects how template files are watched for changes
+type WatchMode int
+
+// Watch modes
+const (
+	// WatchAuto uses fsnotify and falls back to polling for paths (or
+	// everything) fsnotify can't watch
+	WatchAuto WatchMode = iota
+	// WatchNotify only uses fsnotify
+	WatchNotify
+	// WatchPoll only uses polling. Use it for NFS, FUSE or bind mounts that
+	// don't deliver fsnotify events
+	WatchPoll
+)
+
+// fileWatcher is implemented by the fsnotify and polling watchers
+type fileWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// notifyWatcher adapts *fsnotify.Watcher to fileWatcher
+type notifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w notifyWatcher) Events() <-chan fsnotify.Event { return w.Watcher.Events }
+
+func (w notifyWatcher) Errors() <-chan error { return w.Watcher.Errors }
+
+// autoWatcher uses fsnotify and hands paths it fails to watch to a
+// pollWatcher. Both report to the same channels
+type autoWatcher struct {
+	notify *fsnotify.Watcher
+	poll   *pollWatcher
+
+	mu     sync.Mutex
+	polled map[string]bool
+
+	events    chan fsnotify.Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newAutoWatcher(notify *fsnotify.Watcher, interval time.Duration, hash bool) *autoWatcher {
+	w := &autoWatcher{
+		notify: notify,
+		polled: make(map[string]bool),
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+	w.poll = newPollWatcherChans(interval, hash, w.events, w.errors)
+	go w.forward()
+	return w
+}
+
+// forward copies fsnotify's events and errors to the shared channels
+func (w *autoWatcher) forward() {
+	for {
+		select {
+		case ev, ok := <-w.notify.Events:
+			if !ok {
+				return
+			}
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return
+			}
+		case err, ok := <-w.notify.Errors:
+			if !ok {
+				return
+			}
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *autoWatcher) Add(name string) error {
+	err := w.notify.Add(name)
+	if err == nil {
+		return nil
+	}
+	log.Println("polling", name, "because it can't be watched:", err)
+
+	err = w.poll.Add(name)
 	if err != nil {
 		return err
 	}
+	w.mu.Lock()
+	w.polled[name] = true
+	w.mu.Unlock()
+	return nil
+}
 
-	// iterate over old filepaths and remove them
-	for r := result.Next(); r != nil; r = result.Next() {
-		tf := r.(*tmplFilename)
-		err := t.store.tmplWatch.Remove(tf.Filename)
-		if err != nil {
-			return err
-		}
+func (w *autoWatcher) Remove(name string) error {
+	w.mu.Lock()
+	polled := w.polled[name]
+	delete(w.polled, name)
+	w.mu.Unlock()
+
+	if polled {
+		return w.poll.Remove(name)
 	}
+	return w.notify.Remove(name)
+}
 
-	// noop for "Read" transaction but included so I don't go WTF later.
-	tx.Commit()
+func (w *autoWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	w.poll.Close()
+	return w.notify.Close()
+}
+
+func (w *autoWatcher) Events() <-chan fsnotify.Event { return w.events }
+
+func (w *autoWatcher) Errors() <-chan error { return w.errors }
+
+// newWatcher creates the file watcher selected by t.config.Watcher
+func (t *TplSys) newWatcher() fileWatcher {
+	cfg := t.config
+	switch cfg.Watcher {
+	case WatchPoll:
+		return newPollWatcher(cfg.PollInterval, cfg.PollHash)
+	case WatchNotify:
+		return notifyWatcher{fsnotifyMust(fsnotify.NewWatcher())}
+	}
 
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("falling back to polling for template changes:", err)
+		return newPollWatcher(cfg.PollInterval, cfg.PollHash)
+	}
+	return newAutoWatcher(w, cfg.PollInterval, cfg.PollHash)
+}
+
+func (t *TplSys) saveTemplateDataToDB(td *tmplData) error {
 	// add or update tmplData and tmplFilename
 	// Create a write transaction
-	tx = t.store.tmplDB.Txn(true)
+	tx := t.store.tmplDB.Txn(true)
+
+	// old filepaths are unwatched once the new ones are in
+	old, err := templateFiles(tx, td.Name)
+	if err != nil {
+		tx.Abort()
+		return err
+	}
 
 	// Insert or Update new tmplData
 	if err := tx.Insert("tmplData", td); err != nil {
@@ -142,80 +300,540 @@ func (t *TplSys) saveTemplateDataToDB(td *tmplData) error {
 			}
 			err = t.store.tmplWatch.Add(f)
 			if err != nil {
+				tx.Abort()
 				return err
 			}
 		}
 	}
 
+	t.unwatchUnused(tx, old)
+
 	// Commit the transaction
 	tx.Commit()
 	return nil
 }
 
-func (t *TplSys) handleWatcherEvents() {
+// templateFiles returns the files the template with "name" is parsed from
+func templateFiles(tx *memdb.Txn, name string) ([]string, error) {
+	result, err := tx.Get("tmplFilename", "name", name)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for r := result.Next(); r != nil; r = result.Next() {
+		files = append(files, r.(*tmplFilename).Filename)
+	}
+	return files, nil
+}
+
+// unwatchUnused stops watching the files in filenames that no template is
+// parsed from anymore. Several templates can share a file, so its watch stays
+// as long as one of them is left in tx
+func (t *TplSys) unwatchUnused(tx *memdb.Txn, filenames []string) {
+	for _, f := range filenames {
+		r, err := tx.First("tmplFilename", "filename", f)
+		if err == nil && r == nil {
+			// the file may already be gone, in which case so is its watch
+			t.store.tmplWatch.Remove(f)
+		}
+	}
+}
+
+// WatchDir registers every template file in dir (relative to BaseDir) and
+// watches dir and its subdirectories. Files created later are added to the
+// store with baseTmpl as their base template and files that are deleted are
+// removed from it. Templates are keyed by their path relative to BaseDir, so
+// base templates have to be watched before the directories that use them.
+// dir is watched in every root that has it. A file in BaseDir overrides the
+// theme files with the same path, and the theme file is used again if the
+// override is deleted.
+func (t *TplSys) WatchDir(dir, baseTmpl string) error {
+	var paths []string
+	for _, root := range t.roots() {
+		path, err := t.rootPath(root, dir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		// let Walk report the missing directory
+		path, err := t.fullPath(dir)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	// roots are walked in order so overrides are registered first
+	for _, path := range paths {
+		err := t.watchDir(path, baseTmpl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload synchronously applies a change to the template file at path
+// (relative to BaseDir) the same way the watcher would: loaded templates are
+// rebuilt along with their children, new files in watched directories are
+// registered and deleted ones are removed.
+// It is mostly useful in tests, which otherwise have to wait for the watcher
+func (t *TplSys) Reload(path string) error {
+	path, err := t.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return t.fileRemoved(path)
+	}
+
+	names, err := t.templatesForFile(path)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return t.fileCreated(path)
+	}
+	return t.reloadFile(path)
+}
+
+func (t *TplSys) watchDir(dir, baseTmpl string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return t.saveDirToDB(&tmplDir{Dir: path, BaseTmplID: baseTmpl})
+		}
+		return t.registerFile(path, baseTmpl)
+	})
+}
+
+func (t *TplSys) saveDirToDB(d *tmplDir) error {
+	t.store.Lock()
+	defer t.store.Unlock()
+
+	tx := t.store.tmplDB.Txn(true)
+	if err := tx.Insert("tmplDir", d); err != nil {
+		tx.Abort()
+		return err
+	}
+	if err := t.store.tmplWatch.Add(d.Dir); err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// watchedDir returns the watched directory that contains path
+func (t *TplSys) watchedDir(path string) (*tmplDir, bool) {
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	r, err := tx.First("tmplDir", "id", filepath.Dir(path))
+	if err != nil || r == nil {
+		return nil, false
+	}
+	return r.(*tmplDir), true
+}
+
+// templatesForFile returns the names of all templates parsed from filename
+func (t *TplSys) templatesForFile(filename string) ([]string, error) {
+	tx := t.store.tmplDB.Txn(false)
+	defer tx.Abort()
+
+	result, err := tx.Get("tmplFilename", "filename", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for r := result.Next(); r != nil; r = result.Next() {
+		names = append(names, r.(*tmplFilename).Name)
+	}
+	return names, nil
+}
+
+// isTemplateFile reports if a file found in a watched directory should be
+// loaded. Hidden files and editor backups are skipped
+func isTemplateFile(path string) bool {
+	name := filepath.Base(path)
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, "~")
+}
+
+// registerFile adds the template file at path to the store unless it is
+// already loaded. If another root already provided a template with the same
+// key, the template is moved to the file that takes precedence
+func (t *TplSys) registerFile(path, baseTmpl string) error {
+	if !isTemplateFile(path) {
+		return nil
+	}
+	names, err := t.templatesForFile(path)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return nil
+	}
+
+	// saveTemplate expects filenames relative to the roots
+	// and the template is keyed by that path
+	key, err := t.fileKey(path)
+	if err != nil {
+		return err
+	}
+	if t.hasTemplate(key) == nil {
+		_, err = t.rerootTemplate(key)
+		return err
+	}
+	_, err = t.AddTemplate(key, baseTmpl, "", key)
+	return err
+}
+
+// fileKey returns the key of the template loaded from path: its slash
+// separated path relative to its root
+func (t *TplSys) fileKey(path string) (string, error) {
+	root, ok := t.fileRoot(path)
+	if !ok {
+		return "", ErrPathEscapes
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// rerootTemplate looks the files of the template with "name" up in the roots
+// again and reloads it if they now resolve to other files, because an
+// override was added or removed. It reports if the template was reloaded
+func (t *TplSys) rerootTemplate(name string) (bool, error) {
+	tx := t.store.tmplDB.Txn(false)
+	r, err := tx.First("tmplData", "id", name)
+	tx.Abort()
+	if err != nil || r == nil {
+		return false, err
+	}
+	td := r.(*tmplData)
+	if td.HasSrc {
+		return false, nil
+	}
+
+	keys := make([]string, len(td.Filenames))
+	changed := false
+	for i, f := range td.Filenames {
+		keys[i], err = t.fileKey(f)
+		if err != nil {
+			return false, err
+		}
+		path, err := t.fullPath(keys[i])
+		if err != nil {
+			return false, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			// no root has the file
+			return false, nil
+		}
+		if path != f {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	_, err = t.PutTemplate(name, td.BaseTmplID, "", keys...)
+	return err == nil, err
+}
+
+// deleteTemplate deletes the template with "name" from the store along with
+// its tmplDB rows and file watches. It must be called with the store locked
+func (t *TplSys) deleteTemplate(name string) error {
+	tx := t.store.tmplDB.Txn(true)
+	files, err := templateFiles(tx, name)
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+	if _, err := tx.DeleteAll("tmplFilename", "name", name); err != nil {
+		tx.Abort()
+		return err
+	}
+	if _, err := tx.DeleteAll("tmplData", "id", name); err != nil {
+		tx.Abort()
+		return err
+	}
+	t.unwatchUnused(tx, files)
+	tx.Commit()
+
+	t.store.remove(name)
+	return nil
+}
+
+// detachTemplate turns the template with "name" into a root template. Its
+// compiled template is kept. It must be called with the store locked
+func (t *TplSys) detachTemplate(name string) error {
+	tx := t.store.tmplDB.Txn(true)
+	r, err := tx.First("tmplData", "id", name)
+	if err != nil || r == nil {
+		tx.Abort()
+		return err
+	}
+
+	td := *r.(*tmplData)
+	td.BaseTmplID = ""
+	td.HasBaseTmpl = false
+	if err := tx.Insert("tmplData", &td); err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// reloadFile rebuilds every template that was parsed from filename
+func (t *TplSys) reloadFile(filename string) error {
+	// Get template data from DB
+	tx := t.store.tmplDB.Txn(false)
+	result, err := tx.Get("tmplFilename", "filename", filename)
+	if err != nil {
+		return err
+	}
+
+	var tds []*tmplData
+	for r := result.Next(); r != nil; r = result.Next() {
+		tdr, err := tx.First("tmplData", "id", r.(*tmplFilename).Name)
+		if err != nil {
+			return err
+		}
+		if tdr != nil {
+			tds = append(tds, tdr.(*tmplData))
+		}
+	}
+
+	// noop for "Read" transaction but included so I don't go WTF later.
+	tx.Commit()
+
+	var firstErr error
+	for _, td := range tds {
+		// in lazy mode the files are parsed again when the template is next used
+		if t.store.lazy != nil {
+			t.store.Lock()
+			t.unloadTemplate(td.Name)
+			t.publish()
+			t.store.Unlock()
+			continue
+		}
+
+		// get base template
+		// and put the reparsed files on top of it
+		var base, tmpl *template.Template
+		var layer *tmplLayer
+		var err error
+		rootName := td.Name
+		if td.HasBaseTmpl {
+			base, err = t.getTemplate(td.BaseTmplID)
+			if err == nil {
+				rootName = base.Name()
+			}
+		}
+		if err == nil {
+			layer, err = t.parseLayer(td.Name, rootName, "", td.Filenames)
+		}
+		if err == nil {
+			tmpl, err = t.composeTemplate(base, layer)
+		}
+
+		t.store.Lock()
+		if err == nil {
+			// store updated template
+			t.store.put(td.Name, newTmplEntry(tmpl, layer))
+			t.setLoaded(td.Name, nil)
+
+			// rebuild child templates
+			err = t.rebuildChildTemplates(td.Name, tmpl)
+		} else {
+			// keep serving the old template but remember why it wasn't replaced
+			t.setLoaded(td.Name, err)
+		}
+		t.publish()
+		t.store.Unlock()
+		// the other templates of the file are reloaded all the same
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// setLoaded records the outcome of (re)building the template with "name".
+// It must be called with the store locked
+func (t *TplSys) setLoaded(name string, buildErr error) {
+	tx := t.store.tmplDB.Txn(true)
+	r, err := tx.First("tmplData", "id", name)
+	if err != nil || r == nil {
+		tx.Abort()
+		return
+	}
+
+	td := *r.(*tmplData)
+	if buildErr == nil {
+		td.LoadedAt = time.Now()
+	}
+	td.LastErr = buildErr
+	if err := tx.Insert("tmplData", &td); err != nil {
+		tx.Abort()
+		return
+	}
+	tx.Commit()
+}
+
+// fileCreated handles a new file or directory showing up in a watched
+// directory. Editors that save by renaming over the old file end up here too,
+// so files that are already loaded are reloaded
+func (t *TplSys) fileCreated(path string) error {
+	d, ok := t.watchedDir(path)
+	if !ok {
+		// it may still override a template loaded from a later root
+		if key, err := t.fileKey(path); err == nil && t.hasTemplate(key) == nil {
+			_, err = t.rerootTemplate(key)
+			return err
+		}
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		// already gone again
+		return nil
+	}
+	if info.IsDir() {
+		return t.watchDir(path, d.BaseTmplID)
+	}
+
+	names, err := t.templatesForFile(path)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return t.registerFile(path, d.BaseTmplID)
+	}
+
+	// the old watch went away with the old file
+	err = t.store.tmplWatch.Add(path)
+	if err != nil {
+		return err
+	}
+	return t.reloadFile(path)
+}
+
+// fileRemoved unregisters the templates of a file (or all files of a
+// directory) that was deleted from a watched directory
+func (t *TplSys) fileRemoved(path string) error {
+	if _, ok := t.watchedDir(path); !ok {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		// replaced rather than removed. A Create event will follow
+		return nil
+	}
+
+	// collect the removed directory and everything below it
+	tx := t.store.tmplDB.Txn(false)
+	var dirs []string
+	result, err := tx.Get("tmplDir", "id_prefix", path)
+	if err != nil {
+		return err
+	}
+	for r := result.Next(); r != nil; r = result.Next() {
+		d := r.(*tmplDir)
+		if d.Dir == path || strings.HasPrefix(d.Dir, path+string(filepath.Separator)) {
+			dirs = append(dirs, d.Dir)
+		}
+	}
+	var files []string
+	result, err = tx.Get("tmplFilename", "filename_prefix", path)
+	if err != nil {
+		return err
+	}
+	for r := result.Next(); r != nil; r = result.Next() {
+		f := r.(*tmplFilename).Filename
+		if f == path || strings.HasPrefix(f, path+string(filepath.Separator)) {
+			files = append(files, f)
+		}
+	}
+	tx.Abort()
+
+	for _, f := range files {
+		names, err := t.templatesForFile(f)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			// fall back to the same file in a later root
+			ok, err := t.rerootTemplate(name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+
+			// keep pages working when the layout they are based on goes away
+			err = t.RemoveTemplate(name, RemoveDetach)
+			if err != nil && err != ErrTmplNotFound {
+				return err
+			}
+		}
+	}
+
+	if len(dirs) > 0 {
+		t.store.Lock()
+		tx := t.store.tmplDB.Txn(true)
+		for _, d := range dirs {
+			if _, err := tx.DeleteAll("tmplDir", "id", d); err != nil {
+				tx.Abort()
+				t.store.Unlock()
+				return err
+			}
+		}
+		tx.Commit()
+		t.store.Unlock()
+	}
+
+	return nil
+}
+
+func (t *TplSys) handleWatcherEvents(w fileWatcher, quit chan bool) {
 	for {
 		select {
-		case ev := <-t.store.tmplWatch.Events:
-			if ev.Op&fsnotify.Write == fsnotify.Write {
-				// Get template data from DB
-				// Read from TmplDB and remove all old filepaths from watcher
-				tx := t.store.tmplDB.Txn(false)
-				result, err := tx.Get("tmplFilename", "filename", ev.Name)
-				if err != nil {
-					log.Println("error:", err)
-				}
-
-				// iterate over old filepaths and remove them
-				for r := result.Next(); r != nil; r = result.Next() {
-					tf := r.(*tmplFilename)
-
-					tx2 := t.store.tmplDB.Txn(false)
-					tdr, err := tx2.First("tmplData", "id", tf.Name)
-					if err != nil {
-						log.Println("error:", err)
-					}
-					td := tdr.(*tmplData)
-
-					// get base template
-					// or create new one
-					tmpl := template.New(td.Name).Funcs(t.funcMap)
-					if td.HasBaseTmpl {
-						tmpl, err = t.getTemplate(td.BaseTmplID)
-						tmpl, err = tmpl.Clone()
-						if err != nil {
-							log.Println("error:", err)
-						}
-					}
-					tmpl, err = tmpl.ParseFiles(td.Filenames...)
-					if err != nil {
-						log.Println("error:", err)
-					}
-
-					t.store.Lock()
-					// store updated template
-					t.store.tmpls[td.Name] = tmpl
-
-					// rebuild child templates
-					err = t.rebuildChildTemplates(td.Name, tmpl)
-					if err != nil {
-						log.Println("error:", err)
-					}
-					t.store.Unlock()
-
-					// noop for "Read" transaction but included so I don't go WTF later.
-					tx2.Commit()
-				}
-
-				// noop for "Read" transaction but included so I don't go WTF later.
-				tx.Commit()
-				// Rebuild template
-				log.Println("modified file:", ev.Name)
+		case ev := <-w.Events():
+			var err error
+			switch {
+			case ev.Op&fsnotify.Create == fsnotify.Create:
+				err = t.fileCreated(ev.Name)
+			case ev.Op&fsnotify.Write == fsnotify.Write:
+				err = t.reloadFile(ev.Name)
+			case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				err = t.fileRemoved(ev.Name)
+			default:
+				continue
+			}
+			if err != nil {
+				log.Println("error:", err)
 			}
-		case err := <-t.store.tmplWatch.Errors:
+			log.Println("modified file:", ev.Name)
+		case err := <-w.Errors():
 			if err != nil {
 				log.Println("error:", err)
 			}
-		case <-t.store.tmplWatchQuit:
+		case <-quit:
 			return
 		}
 	}